@@ -0,0 +1,162 @@
+package melody
+
+import (
+	"errors"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// BatchFormat 批次訊息的格式 (how the messages of a batch are joined into one frame)
+type BatchFormat int
+
+const (
+	// BatchNewline 以換行分隔 (messages separated by a newline)
+	BatchNewline BatchFormat = iota
+	// BatchJSONArray 以JSON陣列包裝，訊息本身必須是JSON (messages wrapped in a JSON array, they must be JSON themselves)
+	BatchJSONArray
+)
+
+// Batching 批次寫入設定 (limits of the batches written by writePump)
+type Batching struct {
+	MaxMessages int           // 每批最多訊息數，0為不限 (most messages per batch, 0 means no limit)
+	MaxBytes    int           // 每批最多位元組，0為不限 (most bytes of data per batch, 0 means no limit)
+	MaxLatency  time.Duration // 等待更多訊息的時間，0為只取已排隊的 (how long to wait for more messages, 0 only takes what is already queued)
+	Format      BatchFormat
+}
+
+// DialBatching write the direct and topic messages queued for a session in batches, one frame
+// per batch, instead of one frame per message. Only consecutive messages of the same type are
+// batched, control messages (PriorityControl) and close frames are always written on their own.
+func DialBatching(batching Batching) DialOption {
+	return DialOption{func(do *dialOptions) {
+		do.batching = &batching
+	}}
+}
+
+// writeData 寫出直接或主題訊息，啟用批次時一併寫出排隊中的訊息
+// (write a direct or topic message, together with the queued ones when batching is enabled)
+func (s *Session) writeData(msg *envelope) bool {
+	batching := s.melody.batching
+	if batching == nil || (msg.t != websocket.TextMessage && msg.t != websocket.BinaryMessage) {
+		return s.writeQueued(msg)
+	}
+
+	batch, next := s.gather(msg, batching)
+
+	ok := false
+	if len(batch) == 1 {
+		ok = s.writeQueued(batch[0])
+	} else {
+		ok = s.writeBatch(batch, batching.Format)
+	}
+
+	if ok && next != nil {
+		ok = s.writeQueued(next)
+	}
+
+	return ok
+}
+
+// gather 收集同類型的排隊訊息，next為第一個無法放入此批的訊息
+// (collect queued messages of the same type, next is the first message which did not fit into the batch)
+func (s *Session) gather(first *envelope, batching *Batching) (batch []*envelope, next *envelope) {
+	batch = []*envelope{first}
+	size := len(first.msg)
+
+	var deadline <-chan time.Time
+	if batching.MaxLatency > 0 {
+		timer := time.NewTimer(batching.MaxLatency)
+		defer timer.Stop()
+		deadline = timer.C
+	}
+
+	for batching.MaxMessages <= 0 || len(batch) < batching.MaxMessages {
+		var msg *envelope
+
+		select {
+		case msg = <-s.output:
+		default:
+			select {
+			case msg = <-s.output:
+			case m, ok := <-s.subChan:
+				if !ok {
+					return batch, nil
+				}
+				msg = m
+			default:
+				if deadline == nil {
+					return batch, nil
+				}
+
+				select {
+				case msg = <-s.output:
+				case m, ok := <-s.subChan:
+					if !ok {
+						return batch, nil
+					}
+					msg = m
+				case m := <-s.control:
+					return batch, m
+				case <-s.closeOutputChan:
+					return batch, nil
+				case <-deadline:
+					return batch, nil
+				}
+			}
+		}
+
+		if msg.t != first.t || (batching.MaxBytes > 0 && size+len(msg.msg) > batching.MaxBytes) {
+			return batch, msg
+		}
+
+		batch = append(batch, msg)
+		size += len(msg.msg)
+	}
+
+	return batch, nil
+}
+
+// writeBatch 以一個frame寫出整批訊息 (write the whole batch as a single frame)
+func (s *Session) writeBatch(batch []*envelope, format BatchFormat) bool {
+	if s.closed() {
+		s.melody.errorHandler(s, errors.New("tried to write to a closed session"))
+		return false
+	}
+
+	sep := []byte{'\n'}
+	if format == BatchJSONArray {
+		sep = []byte{','}
+	}
+
+	s.conn.SetWriteDeadline(time.Now().Add(s.melody.Config.WriteWait))
+	w, err := s.conn.NextWriter(batch[0].t)
+	if err != nil {
+		s.melody.errorHandler(s, err)
+		return false
+	}
+
+	if format == BatchJSONArray {
+		w.Write([]byte{'['})
+	}
+	for i, msg := range batch {
+		if i > 0 {
+			w.Write(sep)
+		}
+		w.Write(msg.msg)
+	}
+	if format == BatchJSONArray {
+		w.Write([]byte{']'})
+	}
+
+	if err := w.Close(); err != nil {
+		s.melody.errorHandler(s, err)
+		return false
+	}
+
+	for _, msg := range batch {
+		s.sent(msg)
+	}
+
+	return true
+}
@@ -0,0 +1,59 @@
+package melody
+
+// BrokerMessage 跨節點傳遞的訊息 (message carried between nodes by a Broker)
+type BrokerMessage struct {
+	Origin string // 發布的節點 (node which published the message)
+	ID     string // 訊息識別碼，各節點相同 (message id, the same on every node)
+	Topic  string // 發布的主題 (published topic)
+	Type   int    // websocket 訊息類型 (websocket.TextMessage or websocket.BinaryMessage)
+	Data   []byte // 訊息內文 (msg data)
+	Async  bool   // 接收端以非同步方式發布 (deliver with AsyncPub semantics on the receiving node)
+}
+
+// Broker 跨節點的訂閱/發布後端 (cross-node pub/sub backend used by every Melody node)
+//
+// Publish must hand msg to the handler of every other node that subscribed msg.Topic.
+// The publishing node delivers to its own sessions directly and ignores its own
+// messages if the broker echoes them back. Subscribe and Unsubscribe are called from
+// the pub/sub goroutine when the first local subscriber of a topic appears and when
+// the last one leaves, so an implementation must never invoke the handler while
+// holding a lock that Subscribe or Unsubscribe need. The topic may be a wildcard
+// pattern such as "quotes.us.*" or "quotes.>" (see TopicWildcard), which the broker
+// has to match against published topics itself.
+type Broker interface {
+	// SetHandler 設定收到訊息時的處理函式 (set the func invoked for every received message)
+	SetHandler(fn func(*BrokerMessage))
+	// Publish 發布訊息到所有節點 (publish message to all subscribed nodes)
+	Publish(msg *BrokerMessage) error
+	// Subscribe 本節點開始接收此主題 (this node starts receiving the topic)
+	Subscribe(topic string) error
+	// Unsubscribe 本節點停止接收此主題 (this node stops receiving the topic)
+	Unsubscribe(topic string) error
+	// Close 關閉代理 (close the broker)
+	Close() error
+}
+
+// localBroker 預設的單節點代理，沒有其他節點 (default single node broker, there are no other nodes to reach)
+type localBroker struct{}
+
+func newLocalBroker() *localBroker {
+	return &localBroker{}
+}
+
+func (b *localBroker) SetHandler(fn func(*BrokerMessage)) {}
+
+func (b *localBroker) Publish(msg *BrokerMessage) error {
+	return nil
+}
+
+func (b *localBroker) Subscribe(topic string) error {
+	return nil
+}
+
+func (b *localBroker) Unsubscribe(topic string) error {
+	return nil
+}
+
+func (b *localBroker) Close() error {
+	return nil
+}
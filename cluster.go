@@ -0,0 +1,153 @@
+package melody
+
+import (
+	"context"
+	"sync"
+)
+
+// Cluster operations carried by ClusterRequest.Op.
+const (
+	ClusterCloseSessions = "close_sessions"
+	ClusterWriteTo       = "write_to"
+)
+
+// ClusterRequest 發送給叢集所有節點的請求 (request sent to every node of the cluster)
+//
+// Transports that serialize requests must preserve the dynamic type of Value,
+// since sessions are matched with reflect.DeepEqual.
+type ClusterRequest struct {
+	Op              string      // 操作 (operation, e.g. ClusterCloseSessions)
+	Key             string      // Session Key
+	Value           interface{} // Session Key 對應的值 (value stored under Key)
+	KeepSessionHash string      // 保留的 Session (hashID of the session to keep)
+	HashID          string      // 目標 Session (hashID of the target session, used by ClusterWriteTo)
+	Type            int         // 訊息類型 (message type, used by ClusterWriteTo)
+	Data            []byte      // 訊息內容 (message data, used by ClusterWriteTo)
+}
+
+// ClusterResponse 單一節點的回應 (reply of a single node)
+type ClusterResponse struct {
+	NodeID  string // 回應的節點 (replying node)
+	Closed  int    // 關閉的 Session 數量 (number of sessions closed on the node)
+	Written bool   // 目標 Session 在此節點且已寫入 (the target session lives on the node and the message was queued)
+	Error   string // 寫入失敗的原因 (why the target session could not be written to)
+}
+
+// Cluster 節點間的傳輸層 (transport used to fan requests out to every Melody node)
+type Cluster interface {
+	// NodeID 本節點的識別碼 (unique id of this node)
+	NodeID() string
+	// SetHandler 設定收到請求時的處理函式 (set the func serving requests from other nodes)
+	SetHandler(fn func(*ClusterRequest) *ClusterResponse)
+	// Broadcast 發送請求給所有節點（包含自己）並收集回應 (send req to every node, including this one, and collect the replies)
+	Broadcast(ctx context.Context, req *ClusterRequest) ([]*ClusterResponse, error)
+	// Close 離開叢集 (leave the cluster)
+	Close() error
+}
+
+// localCluster 預設的單節點叢集 (default single node cluster)
+type localCluster struct {
+	handler func(*ClusterRequest) *ClusterResponse
+}
+
+func newLocalCluster() *localCluster {
+	return &localCluster{handler: func(*ClusterRequest) *ClusterResponse { return &ClusterResponse{} }}
+}
+
+func (c *localCluster) NodeID() string {
+	return "local"
+}
+
+func (c *localCluster) SetHandler(fn func(*ClusterRequest) *ClusterResponse) {
+	c.handler = fn
+}
+
+func (c *localCluster) Broadcast(ctx context.Context, req *ClusterRequest) ([]*ClusterResponse, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	return []*ClusterResponse{c.handler(req)}, nil
+}
+
+func (c *localCluster) Close() error {
+	return nil
+}
+
+// MemoryCluster 記憶體內的叢集，用於測試 (in-process cluster, mainly for tests)
+type MemoryCluster struct {
+	mutex sync.RWMutex
+	nodes map[string]*memoryClusterNode
+}
+
+// NewMemoryCluster creates an empty in-process cluster.
+func NewMemoryCluster() *MemoryCluster {
+	return &MemoryCluster{nodes: make(map[string]*memoryClusterNode)}
+}
+
+// Node joins a new node with the given id to the cluster.
+func (mc *MemoryCluster) Node(id string) Cluster {
+	node := &memoryClusterNode{
+		id:      id,
+		cluster: mc,
+		handler: func(*ClusterRequest) *ClusterResponse { return &ClusterResponse{} },
+	}
+
+	mc.mutex.Lock()
+	mc.nodes[id] = node
+	mc.mutex.Unlock()
+
+	return node
+}
+
+type memoryClusterNode struct {
+	id      string
+	cluster *MemoryCluster
+	mutex   sync.RWMutex
+	handler func(*ClusterRequest) *ClusterResponse
+}
+
+func (n *memoryClusterNode) NodeID() string {
+	return n.id
+}
+
+func (n *memoryClusterNode) SetHandler(fn func(*ClusterRequest) *ClusterResponse) {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	n.handler = fn
+}
+
+func (n *memoryClusterNode) serve(req *ClusterRequest) *ClusterResponse {
+	n.mutex.RLock()
+	handler := n.handler
+	n.mutex.RUnlock()
+
+	return handler(req)
+}
+
+func (n *memoryClusterNode) Broadcast(ctx context.Context, req *ClusterRequest) ([]*ClusterResponse, error) {
+	n.cluster.mutex.RLock()
+	nodes := make([]*memoryClusterNode, 0, len(n.cluster.nodes))
+	for _, node := range n.cluster.nodes {
+		nodes = append(nodes, node)
+	}
+	n.cluster.mutex.RUnlock()
+
+	responses := make([]*ClusterResponse, 0, len(nodes))
+	for _, node := range nodes {
+		if err := ctx.Err(); err != nil {
+			return responses, err
+		}
+
+		responses = append(responses, node.serve(req))
+	}
+
+	return responses, nil
+}
+
+func (n *memoryClusterNode) Close() error {
+	n.cluster.mutex.Lock()
+	defer n.cluster.mutex.Unlock()
+	delete(n.cluster.nodes, n.id)
+	return nil
+}
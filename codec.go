@@ -0,0 +1,82 @@
+package melody
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+
+	"github.com/gorilla/websocket"
+)
+
+// Codec 編碼值的方式 (encodes values written with Session.WriteValue and Melody.PublishValue)
+type Codec interface {
+	// Marshal 編碼 (encode v)
+	Marshal(v interface{}) ([]byte, error)
+	// Unmarshal 解碼 (decode data into v)
+	Unmarshal(data []byte, v interface{}) error
+	// MessageType 訊息類型 (websocket.TextMessage or websocket.BinaryMessage)
+	MessageType() int
+}
+
+// JSONCodec encodes values as JSON text messages, it is the default Codec.
+type JSONCodec struct{}
+
+// Marshal implements Codec.
+func (JSONCodec) Marshal(v interface{}) ([]byte, error) {
+	return json.Marshal(v)
+}
+
+// Unmarshal implements Codec.
+func (JSONCodec) Unmarshal(data []byte, v interface{}) error {
+	return json.Unmarshal(data, v)
+}
+
+// MessageType implements Codec.
+func (JSONCodec) MessageType() int {
+	return websocket.TextMessage
+}
+
+// DialCodec set the Codec used by Session.WriteValue and Melody.PublishValue, JSONCodec by default.
+func DialCodec(c Codec) DialOption {
+	return DialOption{func(do *dialOptions) {
+		do.codec = c
+	}}
+}
+
+// PublishValue encodes v once with the Codec and publishes it to every subscriber of topic,
+// as a text or binary message depending on the Codec.
+func (m *Melody) PublishValue(topic string, v interface{}) error {
+	data, err := m.codec.Marshal(v)
+	if err != nil {
+		return err
+	}
+
+	message := &envelope{t: m.codec.MessageType(), msg: data}
+	_, err = m.pubsub.PubContext(context.Background(), message, false, topic)
+	return err
+}
+
+// WriteValue encodes v with the Codec and writes it to the session.
+func (s *Session) WriteValue(v interface{}) error {
+	return s.writeCodec(s.melody.codec, v)
+}
+
+// WriteJSON encodes v as JSON and writes it to the session as a text message.
+func (s *Session) WriteJSON(v interface{}) error {
+	return s.writeCodec(JSONCodec{}, v)
+}
+
+func (s *Session) writeCodec(c Codec, v interface{}) error {
+	if s.closed() {
+		return errors.New("session is closed")
+	}
+
+	data, err := c.Marshal(v)
+	if err != nil {
+		return err
+	}
+
+	s.writeMessage(&envelope{t: c.MessageType(), msg: data})
+
+	return nil
+}
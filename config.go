@@ -9,6 +9,7 @@ type Config struct {
 	PingPeriod        time.Duration // Milliseconds between pings.
 	MaxMessageSize    int64         // Maximum size in bytes of a message.
 	MessageBufferSize int           // The max amount of messages that can be in a sessions buffer before it starts dropping them.
+	ControlBufferSize int           // The max amount of control messages (PriorityControl) that can be in a sessions buffer.
 }
 
 func newConfig() *Config {
@@ -18,5 +19,6 @@ func newConfig() *Config {
 		PingPeriod:        (60 * time.Second * 9) / 10,
 		MaxMessageSize:    512,
 		MessageBufferSize: 256,
+		ControlBufferSize: 64,
 	}
 }
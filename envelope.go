@@ -1,9 +1,49 @@
 package melody
 
+import (
+	"encoding/json"
+
+	"github.com/gorilla/websocket"
+)
+
 type envelope struct {
-	t      int
-	msg    []byte
-	filter filterFunc
+	t        int
+	msg      []byte
+	filter   filterFunc
+	topic    string                     // 發布的主題 (topic the message was published to, empty for direct writes)
+	seq      uint64                     // 主題內的序號 (per-topic sequence number)
+	id       string                     // 訊息識別碼 (unique message id)
+	raw      []byte                     // 封裝前的內文 (msg before framing, nil when not framed)
+	priority Priority                   // 寫入佇列的優先順序 (queue the message is written to, PriorityDirect by default)
+	prepared *websocket.PreparedMessage // 預先編碼的frame (frames encoded once for every session, may be nil)
+}
+
+// prepare 預先編碼frame，框架與壓縮只做一次 (pre-encode the message so framing and compression happen once, not once per session)
+func (e *envelope) prepare() *envelope {
+	if prepared, err := websocket.NewPreparedMessage(e.t, e.msg); err == nil {
+		e.prepared = prepared
+	}
+
+	return e
+}
+
+// Message 發布到主題的訊息 (a message published to a topic)
+type Message struct {
+	Topic string // 主題 (topic the message was published to)
+	Seq   uint64 // 主題內遞增的序號 (monotonically increasing per-topic sequence number)
+	ID    string // 訊息識別碼 (unique message id, the same on every node)
+	Type  int    // websocket.TextMessage or websocket.BinaryMessage
+	Data  []byte // 內文 (published data)
+}
+
+// message 轉為對外的Message (the public view of a topic envelope)
+func (e *envelope) message() *Message {
+	data := e.msg
+	if e.raw != nil {
+		data = e.raw
+	}
+
+	return &Message{Topic: e.topic, Seq: e.seq, ID: e.id, Type: e.t, Data: data}
 }
 
 type closesession struct {
@@ -12,3 +52,28 @@ type closesession struct {
 	value           interface{}
 	keepSessionHash string
 }
+
+// jsonTopicFrame JSONTopicFramer 的格式 (frame written by JSONTopicFramer)
+type jsonTopicFrame struct {
+	Topic string      `json:"topic"`
+	Seq   uint64      `json:"seq"`
+	ID    string      `json:"id"`
+	Data  interface{} `json:"data"`
+}
+
+// JSONTopicFramer frames a topic message as {"topic":..,"seq":..,"id":..,"data":..}.
+// Text data which is valid JSON is embedded as is, other text data as a string and
+// binary data as a base64 string.
+func JSONTopicFramer(msg *Message) []byte {
+	frame := jsonTopicFrame{Topic: msg.Topic, Seq: msg.Seq, ID: msg.ID, Data: msg.Data}
+	if msg.Type == websocket.TextMessage {
+		if json.Valid(msg.Data) {
+			frame.Data = json.RawMessage(msg.Data)
+		} else {
+			frame.Data = string(msg.Data)
+		}
+	}
+
+	data, _ := json.Marshal(frame)
+	return data
+}
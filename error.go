@@ -1,9 +1,29 @@
 package melody
 
-import "errors"
+import (
+	"errors"
+	"fmt"
+)
 
 var (
 	ErrWriteToCloseSessionForRecover = errors.New("tried to write to closed a session for recover")
 	ErrWriteToCloseSession           = errors.New("tried to write to closed a session")
 	ErrSessionMessageBufferIsFull    = errors.New("session message buffer is full")
+	ErrPubSubShutdown                = errors.New("pubsub is shut down")
+	ErrInvalidRPCPayload             = errors.New("rpc payload is not valid json")
+	ErrRequestSessionClosed          = errors.New("session closed before the response arrived")
+	ErrSessionNotFound               = errors.New("session not found")
+	ErrInvalidSessionID              = errors.New("session id is invalid or already in use")
+	ErrMelodyClosed                  = errors.New("melody instance is closed")
+	ErrSlowConsumer                  = errors.New("session closed as a slow consumer")
 )
+
+// PanicError is passed to HandleError when a handler panics, the session is then closed.
+type PanicError struct {
+	Value interface{} // 傳給panic的值 (the value passed to panic)
+	Stack []byte      // 發生panic的goroutine堆疊 (stack of the panicking goroutine)
+}
+
+func (e *PanicError) Error() string {
+	return fmt.Sprintf("melody: handler panicked: %v", e.Value)
+}
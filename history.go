@@ -0,0 +1,190 @@
+package melody
+
+import (
+	"sort"
+	"time"
+)
+
+// Replay 訂閱時重播的歷史訊息 (history replayed to a channel when it subscribes)
+//
+// If Since is set every kept message with a greater sequence number is replayed,
+// otherwise the Last kept messages are, a negative Last replays nothing. Replayed messages which do not fit into the
+// subscribe channel buffer are dropped.
+type Replay struct {
+	Last  int    // 最後幾筆 (replay the last n messages)
+	Since uint64 // 此序號之後 (replay every message after this sequence number)
+}
+
+// historyEntry 歷史訊息 (a published message kept by topicHistory)
+type historyEntry struct {
+	at  time.Time
+	msg *envelope
+}
+
+// topicHistory 單一主題的環狀緩衝 (ring buffer of the messages published to one topic)
+type topicHistory struct {
+	ttl     time.Duration // 保留時間，0為不過期 (how long messages are kept, 0 keeps them until overwritten)
+	entries []historyEntry
+	head    int // 最舊一筆的位置 (index of the oldest entry)
+	count   int
+}
+
+func newTopicHistory(size int, ttl time.Duration) *topicHistory {
+	return &topicHistory{ttl: ttl, entries: make([]historyEntry, size)}
+}
+
+func (h *topicHistory) append(msg *envelope, now time.Time) {
+	entry := historyEntry{at: now, msg: msg}
+
+	if h.count < len(h.entries) {
+		h.entries[(h.head+h.count)%len(h.entries)] = entry
+		h.count++
+		return
+	}
+
+	h.entries[h.head] = entry
+	h.head = (h.head + 1) % len(h.entries)
+}
+
+// expire 移除過期的訊息 (drop the messages older than ttl)
+func (h *topicHistory) expire(now time.Time) {
+	if h.ttl <= 0 {
+		return
+	}
+
+	for h.count > 0 && now.Sub(h.entries[h.head].at) > h.ttl {
+		h.entries[h.head] = historyEntry{}
+		h.head = (h.head + 1) % len(h.entries)
+		h.count--
+	}
+}
+
+// replay 依照Replay取出訊息，由舊到新 (select the entries asked for by replay, oldest first)
+func (h *topicHistory) replay(replay *Replay, now time.Time) []historyEntry {
+	h.expire(now)
+
+	entries := make([]historyEntry, 0, h.count)
+	for i := 0; i < h.count; i++ {
+		entry := h.entries[(h.head+i)%len(h.entries)]
+		if replay.Since > 0 && entry.msg.seq <= replay.Since {
+			continue
+		}
+		entries = append(entries, entry)
+	}
+
+	if replay.Since == 0 {
+		entries = lastEntries(entries, replay.Last)
+	}
+
+	return entries
+}
+
+// lastEntries 最後n筆，負數視為0 (the last n entries, a negative n selects none)
+func lastEntries(entries []historyEntry, n int) []historyEntry {
+	if n < 0 {
+		n = 0
+	}
+	if n >= len(entries) {
+		return entries
+	}
+
+	return entries[len(entries)-n:]
+}
+
+// historyConfig 主題歷史設定 (history settings of a topic, size 0 disables it)
+type historyConfig struct {
+	size int
+	ttl  time.Duration
+}
+
+// record 記錄發布到主題的訊息 (keep a message published to topic)
+func (reg *register) record(topic string, msg *envelope) {
+	history, ok := reg.histories[topic]
+	if !ok {
+		config := reg.historyConfigOf(topic)
+		if config.size <= 0 {
+			return
+		}
+
+		history = newTopicHistory(config.size, config.ttl)
+		reg.histories[topic] = history
+	}
+
+	history.append(msg, time.Now())
+}
+
+func (reg *register) historyConfigOf(topic string) historyConfig {
+	if config, ok := reg.historyConfigs[topic]; ok {
+		return config
+	}
+
+	return reg.defaultHistory
+}
+
+// replay 將主題的歷史訊息送給剛訂閱的channel (send the kept messages of topic to ch)
+func (reg *register) replay(topic string, ch chan *envelope, replay *Replay) {
+	if history, ok := reg.histories[topic]; ok {
+		queueReplay(ch, history.replay(replay, time.Now()))
+	}
+}
+
+// matchingHistory 符合萬用字元的本worker主題所保留的訊息，所有worker回覆後才由mergeReplay排序與截取
+// (entries kept by the topics of this worker matching pattern, ordered and cut by mergeReplay once every worker answered)
+func (reg *register) matchingHistory(pattern string, replay *Replay) []historyEntry {
+	now := time.Now()
+
+	var entries []historyEntry
+	for name, history := range reg.histories {
+		if matchTopic(pattern, name) {
+			entries = append(entries, history.replay(replay, now)...)
+		}
+	}
+
+	return entries
+}
+
+// mergeReplay 依發布時間排序各主題的訊息並套用Last (order the entries of several topics by publish time and apply Last)
+func mergeReplay(entries []historyEntry, replay *Replay) []historyEntry {
+	sort.SliceStable(entries, func(i, j int) bool {
+		return entries[i].at.Before(entries[j].at)
+	})
+
+	if replay.Since == 0 {
+		entries = lastEntries(entries, replay.Last)
+	}
+
+	return entries
+}
+
+// queueReplay 不阻塞地送出重播訊息，放不下的捨棄 (queue the replayed messages without blocking, those which do not fit are dropped)
+func queueReplay(ch chan *envelope, entries []historyEntry) {
+	for _, entry := range entries {
+		select {
+		case ch <- entry.msg:
+		default:
+		}
+	}
+}
+
+// setHistory 設定主題歷史，大小改變時清除已保留的訊息 (configure the history of topic, kept messages are dropped when the size changes)
+func (reg *register) setHistory(topic string, config historyConfig) {
+	reg.historyConfigs[topic] = config
+
+	history, ok := reg.histories[topic]
+	if !ok {
+		return
+	}
+
+	if config.size <= 0 {
+		delete(reg.histories, topic)
+		reg.forget(topic)
+		return
+	}
+
+	if config.size != len(history.entries) {
+		reg.histories[topic] = newTopicHistory(config.size, config.ttl)
+		return
+	}
+
+	history.ttl = config.ttl
+}
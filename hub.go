@@ -1,63 +1,69 @@
 package melody
 
 import (
-	"reflect"
+	"hash/fnv"
 	"sync"
 )
 
 type hub struct {
-	sessions     map[*Session]bool
-	broadcast    chan *envelope
-	closesession chan *closesession
-	register     chan *Session
-	unregister   chan *Session
-	exit         chan *envelope
-	open         bool
-	rwmutex      *sync.RWMutex
+	sessions   map[*Session]bool
+	byHash     map[string]*Session // Key: hashID
+	reserved   map[string]bool     // 升級中尚未註冊的hashID (hashIDs of connections being upgraded, Key: hashID)
+	broadcast  chan *envelope
+	register   chan *Session
+	unregister chan *Session
+	exit       chan *envelope
+	drain      chan chan []*Session
+	open       bool
+	rwmutex    *sync.RWMutex
+	metrics    Metrics
+	index      *keyIndex     // 所有分片共用的索引 (index shared by every shard)
+	done       chan struct{} // 分片停止後關閉 (closed once the shard loop exited)
 }
 
-func newHub() *hub {
+func newHub(metrics Metrics, index *keyIndex) *hub {
 	return &hub{
-		sessions:     make(map[*Session]bool),
-		broadcast:    make(chan *envelope),
-		closesession: make(chan *closesession),
-		register:     make(chan *Session),
-		unregister:   make(chan *Session),
-		exit:         make(chan *envelope),
-		open:         true,
-		rwmutex:      &sync.RWMutex{},
+		sessions:   make(map[*Session]bool),
+		byHash:     make(map[string]*Session),
+		reserved:   make(map[string]bool),
+		broadcast:  make(chan *envelope),
+		register:   make(chan *Session),
+		unregister: make(chan *Session),
+		exit:       make(chan *envelope),
+		drain:      make(chan chan []*Session),
+		open:       true,
+		rwmutex:    &sync.RWMutex{},
+		metrics:    metrics,
+		index:      index,
+		done:       make(chan struct{}),
 	}
 }
 
 func (h *hub) run() {
+	defer close(h.done)
+
 loop:
 	for {
 		select {
 		case s := <-h.register:
 			h.rwmutex.Lock()
 			h.sessions[s] = true
+			h.byHash[s.hashID] = s
+			delete(h.reserved, s.hashID)
 			h.rwmutex.Unlock()
+			h.index.add(s)
+			h.metrics.SessionOpened()
 		case s := <-h.unregister:
 			if _, ok := h.sessions[s]; ok {
 				h.rwmutex.Lock()
 				delete(h.sessions, s)
-				h.rwmutex.Unlock()
-			}
-		case cs := <-h.closesession:
-			h.rwmutex.Lock()
-			for s := range h.sessions {
-				if cs.keepSessionHash != "" && reflect.DeepEqual(s.hashID, cs.keepSessionHash) {
-					continue
-				}
-
-				if data, isExist := s.Get(cs.key); isExist {
-					if reflect.DeepEqual(data, cs.value) {
-						s.Close()
-						break
-					}
+				if h.byHash[s.hashID] == s {
+					delete(h.byHash, s.hashID)
 				}
+				h.rwmutex.Unlock()
+				h.index.remove(s)
+				h.metrics.SessionClosed()
 			}
-			h.rwmutex.Unlock()
 		case m := <-h.broadcast:
 			h.rwmutex.RLock()
 			for s := range h.sessions {
@@ -75,11 +81,28 @@ loop:
 			for s := range h.sessions {
 				s.writeMessage(m)
 				delete(h.sessions, s)
+				delete(h.byHash, s.hashID)
+				h.index.remove(s)
+				h.metrics.SessionClosed()
 				s.Close()
 			}
 			h.open = false
 			h.rwmutex.Unlock()
 			break loop
+		case sessions := <-h.drain:
+			h.rwmutex.Lock()
+			drained := make([]*Session, 0, len(h.sessions))
+			for s := range h.sessions {
+				drained = append(drained, s)
+				delete(h.sessions, s)
+				delete(h.byHash, s.hashID)
+				h.index.remove(s)
+				h.metrics.SessionClosed()
+			}
+			h.open = false
+			h.rwmutex.Unlock()
+			sessions <- drained
+			break loop
 		}
 	}
 }
@@ -90,9 +113,202 @@ func (h *hub) closed() bool {
 	return !h.open
 }
 
+// session 以hashID查詢 (look a session up by hashID)
+func (h *hub) session(hashID string) (*Session, bool) {
+	h.rwmutex.RLock()
+	defer h.rwmutex.RUnlock()
+
+	s, ok := h.byHash[hashID]
+	return s, ok
+}
+
+// reserve 保留未使用的hashID (reserve hashID unless a session or another connection uses it)
+func (h *hub) reserve(hashID string) bool {
+	h.rwmutex.Lock()
+	defer h.rwmutex.Unlock()
+
+	if _, ok := h.byHash[hashID]; ok || h.reserved[hashID] || !h.open {
+		return false
+	}
+
+	h.reserved[hashID] = true
+	return true
+}
+
+// release 取消保留 (drop the reservation of hashID)
+func (h *hub) release(hashID string) {
+	h.rwmutex.Lock()
+	delete(h.reserved, hashID)
+	h.rwmutex.Unlock()
+}
+
 func (h *hub) len() int {
 	h.rwmutex.RLock()
 	defer h.rwmutex.RUnlock()
 
 	return len(h.sessions)
 }
+
+// shardedHub 依hashID分片的hub，每個分片有自己的goroutine (hub partitioned by hashID, every shard runs on its own goroutine)
+// 註冊只會等待所屬分片，廣播由所有分片平行送出 (registrations only wait for their own shard, broadcasts fan out on every shard in parallel)
+type shardedHub struct {
+	shards   []*hub
+	index    *keyIndex
+	open     bool
+	closeMsg []byte // 關閉時送給晚到連線的close frame (close payload sent to connections upgraded after the hub closed)
+	rwmutex  *sync.RWMutex
+}
+
+func newShardedHub(shards int, metrics Metrics) *shardedHub {
+	if shards < 1 {
+		shards = 1
+	}
+
+	h := &shardedHub{
+		shards:  make([]*hub, shards),
+		index:   newKeyIndex(),
+		open:    true,
+		rwmutex: &sync.RWMutex{},
+	}
+	for i := range h.shards {
+		h.shards[i] = newHub(metrics, h.index)
+	}
+
+	return h
+}
+
+func (h *shardedHub) run() {
+	for _, shard := range h.shards {
+		go shard.run()
+	}
+}
+
+// shard hashID所屬的分片 (shard owning the session with hashID)
+func (h *shardedHub) shard(hashID string) *hub {
+	if len(h.shards) == 1 {
+		return h.shards[0]
+	}
+
+	hash := fnv.New32a()
+	hash.Write([]byte(hashID))
+	return h.shards[hash.Sum32()%uint32(len(h.shards))]
+}
+
+// register 註冊Session，分片已停止時回傳ErrMelodyClosed (register the session, ErrMelodyClosed once its shard stopped)
+func (h *shardedHub) register(s *Session) error {
+	shard := h.shard(s.hashID)
+
+	select {
+	case shard.register <- s:
+		return nil
+	case <-shard.done:
+		shard.release(s.hashID)
+		return ErrMelodyClosed
+	}
+}
+
+// reserve 在所屬分片保留hashID (reserve hashID on its shard)
+func (h *shardedHub) reserve(hashID string) bool {
+	return h.shard(hashID).reserve(hashID)
+}
+
+// release 取消保留 (drop the reservation of hashID)
+func (h *shardedHub) release(hashID string) {
+	h.shard(hashID).release(hashID)
+}
+
+func (h *shardedHub) unregister(s *Session) {
+	shard := h.shard(s.hashID)
+
+	select {
+	case shard.unregister <- s:
+	case <-shard.done:
+	}
+}
+
+// session 只查詢所屬的分片 (look a session up on its own shard only)
+func (h *shardedHub) session(hashID string) (*Session, bool) {
+	return h.shard(hashID).session(hashID)
+}
+
+func (h *shardedHub) broadcast(m *envelope) {
+	for _, shard := range h.shards {
+		select {
+		case shard.broadcast <- m:
+		case <-shard.done:
+		}
+	}
+}
+
+// closeSessions 以索引找出並關閉符合的Session，回傳總數 (close the sessions found through the index, returns how many were closed)
+func (h *shardedHub) closeSessions(cs *closesession) int {
+	closed := 0
+	for _, s := range h.index.find(cs.key, cs.value) {
+		if cs.keepSessionHash != "" && s.hashID == cs.keepSessionHash {
+			continue
+		}
+
+		if s.Close() == nil {
+			closed++
+		}
+	}
+
+	return closed
+}
+
+func (h *shardedHub) exit(m *envelope) {
+	h.close(m.msg)
+	for _, shard := range h.shards {
+		select {
+		case shard.exit <- m:
+		case <-shard.done:
+		}
+	}
+}
+
+// drain 移除並回傳所有Session後停止，msg為之後連線收到的close frame
+// (remove and return every session, then stop; msg is the close payload of connections upgraded afterwards)
+func (h *shardedHub) drain(msg []byte) []*Session {
+	h.close(msg)
+
+	var sessions []*Session
+	for _, shard := range h.shards {
+		drained := make(chan []*Session, 1)
+		select {
+		case shard.drain <- drained:
+			sessions = append(sessions, <-drained...)
+		case <-shard.done:
+		}
+	}
+
+	return sessions
+}
+
+func (h *shardedHub) close(msg []byte) {
+	h.rwmutex.Lock()
+	h.open = false
+	h.closeMsg = msg
+	h.rwmutex.Unlock()
+}
+
+// closeMessage 關閉時的close frame (close payload the hub was closed with)
+func (h *shardedHub) closeMessage() []byte {
+	h.rwmutex.RLock()
+	defer h.rwmutex.RUnlock()
+	return h.closeMsg
+}
+
+func (h *shardedHub) closed() bool {
+	h.rwmutex.RLock()
+	defer h.rwmutex.RUnlock()
+	return !h.open
+}
+
+func (h *shardedHub) len() int {
+	n := 0
+	for _, shard := range h.shards {
+		n += shard.len()
+	}
+
+	return n
+}
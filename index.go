@@ -0,0 +1,195 @@
+package melody
+
+import (
+	"errors"
+	"reflect"
+	"sync"
+
+	"github.com/gorilla/websocket"
+)
+
+// keyIndex 已註冊Session的次要索引 (secondary indexes of the registered sessions by their Keys)
+// keys     Key: 宣告的key, Value: 值對應的Session (declared key, sessions by value)
+// sessions Key: 已註冊的Session, Value: 已建立索引的值 (registered session, values it is indexed under)
+type keyIndex struct {
+	mutex    *sync.RWMutex
+	keys     map[string]map[interface{}]map[*Session]bool
+	sessions map[*Session]map[string]interface{}
+}
+
+func newKeyIndex() *keyIndex {
+	return &keyIndex{
+		mutex:    &sync.RWMutex{},
+		keys:     make(map[string]map[interface{}]map[*Session]bool),
+		sessions: make(map[*Session]map[string]interface{}),
+	}
+}
+
+// indexable 值可以當作map的key (whether value can be used as a map key, other values are matched by scanning)
+func indexable(value interface{}) bool {
+	return hashable(reflect.ValueOf(value))
+}
+
+// hashable 檢查實際的值，介面欄位內的slice等型別也無法當作key
+// (check the dynamic value, a struct whose interface field holds e.g. a slice passes Type.Comparable but cannot be hashed)
+func hashable(v reflect.Value) bool {
+	switch v.Kind() {
+	case reflect.Invalid:
+		return true
+	case reflect.Interface:
+		return v.IsNil() || hashable(v.Elem())
+	case reflect.Struct:
+		for i := 0; i < v.NumField(); i++ {
+			if !hashable(v.Field(i)) {
+				return false
+			}
+		}
+		return true
+	case reflect.Array:
+		for i := 0; i < v.Len(); i++ {
+			if !hashable(v.Index(i)) {
+				return false
+			}
+		}
+		return v.Type().Comparable()
+	}
+
+	return v.Type().Comparable()
+}
+
+// declare 宣告索引並加入已註冊的Session (declare key and index the sessions already registered)
+func (idx *keyIndex) declare(key string) {
+	idx.mutex.Lock()
+	defer idx.mutex.Unlock()
+
+	if _, ok := idx.keys[key]; ok {
+		return
+	}
+
+	idx.keys[key] = make(map[interface{}]map[*Session]bool)
+	for s := range idx.sessions {
+		idx.index(s, key)
+	}
+}
+
+// add Session已註冊 (a session was registered)
+func (idx *keyIndex) add(s *Session) {
+	idx.mutex.Lock()
+	defer idx.mutex.Unlock()
+
+	if _, ok := idx.sessions[s]; ok {
+		return
+	}
+
+	idx.sessions[s] = make(map[string]interface{})
+	for key := range idx.keys {
+		idx.index(s, key)
+	}
+}
+
+// remove Session已移除 (a session was unregistered)
+func (idx *keyIndex) remove(s *Session) {
+	idx.mutex.Lock()
+	defer idx.mutex.Unlock()
+
+	for key := range idx.sessions[s] {
+		idx.unindex(s, key)
+	}
+	delete(idx.sessions, s)
+}
+
+// update Session.Set 後重新索引 (reindex key of s after Session.Set)
+func (idx *keyIndex) update(s *Session, key string) {
+	idx.mutex.Lock()
+	defer idx.mutex.Unlock()
+
+	if _, ok := idx.keys[key]; !ok {
+		return
+	}
+	if _, ok := idx.sessions[s]; !ok {
+		return
+	}
+
+	idx.unindex(s, key)
+	idx.index(s, key)
+}
+
+// index 以目前的值索引 (index s under its current value of key, must hold the lock)
+func (idx *keyIndex) index(s *Session, key string) {
+	value, ok := s.Get(key)
+	if !ok || !indexable(value) {
+		return
+	}
+
+	values := idx.keys[key]
+	if values[value] == nil {
+		values[value] = make(map[*Session]bool)
+	}
+	values[value][s] = true
+	idx.sessions[s][key] = value
+}
+
+// unindex 移除索引 (remove s from the index of key, must hold the lock)
+func (idx *keyIndex) unindex(s *Session, key string) {
+	value, ok := idx.sessions[s][key]
+	if !ok {
+		return
+	}
+
+	values := idx.keys[key]
+	delete(values[value], s)
+	if len(values[value]) == 0 {
+		delete(values, value)
+	}
+	delete(idx.sessions[s], key)
+}
+
+// find Key對應值的Session，未宣告的key或無法索引的值以reflect.DeepEqual逐一比對
+// (sessions storing value under key, undeclared keys and unindexable values fall back to a reflect.DeepEqual scan)
+func (idx *keyIndex) find(key string, value interface{}) []*Session {
+	idx.mutex.RLock()
+	defer idx.mutex.RUnlock()
+
+	var sessions []*Session
+	if values, ok := idx.keys[key]; ok && indexable(value) {
+		for s := range values[value] {
+			sessions = append(sessions, s)
+		}
+		return sessions
+	}
+
+	for s := range idx.sessions {
+		if data, ok := s.Get(key); ok && reflect.DeepEqual(data, value) {
+			sessions = append(sessions, s)
+		}
+	}
+
+	return sessions
+}
+
+// IndexKey declares a secondary index on the session key, kept up to date by Session.Set and
+// HandleRequestWithKeys, so SessionsByKey, WriteToKey and CloseSessions find the sessions
+// storing a value under key without scanning every session. Indexed values are matched with ==,
+// values which cannot be map keys (slices, maps, funcs) are not indexed and fall back to a scan.
+func (m *Melody) IndexKey(key string) {
+	m.hub.index.declare(key)
+}
+
+// SessionsByKey returns the local sessions storing value under key.
+func (m *Melody) SessionsByKey(key string, value interface{}) []*Session {
+	return m.hub.index.find(key, value)
+}
+
+// WriteToKey writes a text message to the local sessions storing value under key.
+func (m *Melody) WriteToKey(key string, value interface{}, msg []byte) error {
+	if m.hub.closed() {
+		return errors.New("melody instance is closed")
+	}
+
+	message := (&envelope{t: websocket.TextMessage, msg: msg}).prepare()
+	for _, s := range m.hub.index.find(key, value) {
+		s.writeMessage(message)
+	}
+
+	return nil
+}
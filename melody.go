@@ -1,9 +1,12 @@
 package melody
 
 import (
+	"context"
 	"errors"
 	"net/http"
+	"runtime"
 	"sync"
+	"time"
 
 	uuid "github.com/satori/go.uuid"
 
@@ -53,6 +56,8 @@ type handleMessageFunc func(*Session, []byte)
 type handleErrorFunc func(*Session, error)
 type handleCloseFunc func(*Session, int, string) error
 type handleSessionFunc func(*Session)
+type handleBrokerErrorFunc func(error)
+type handleTopicMessageFunc func(*Session, *Message)
 type filterFunc func(*Session) bool
 
 // Melody implements a websocket manager.
@@ -68,8 +73,27 @@ type Melody struct {
 	connectHandler           handleSessionFunc
 	disconnectHandler        handleSessionFunc
 	pongHandler              handleSessionFunc
-	hub                      *hub
+	topicMessageSentHandler  handleTopicMessageFunc
+	resumeHandler            handleSessionFunc
+	requestMessageHandler    handleRequestMessageFunc
+	brokerErrorHandler       handleBrokerErrorFunc
+	slowConsumerHandler      handleSlowConsumerFunc
+	slowReports              *slowConsumerReports
+	middleware               []MiddlewareFunc
+	hub                      *shardedHub
 	pubsub                   *pubSub
+	cluster                  Cluster
+	presence                 *presence
+	router                   *router
+	codec                    Codec
+	metrics                  Metrics
+	slowConsumer             *SlowConsumer
+	batching                 *Batching
+	resumeTimeout            time.Duration
+	sessionID                func(*http.Request) string
+	clientSessionID          func(*http.Request, string) bool
+	parked                   map[string]*parkedSession
+	parkedMutex              *sync.Mutex
 }
 
 // DialOption specifies an option for dialing a Melody server.
@@ -78,10 +102,24 @@ type DialOption struct {
 }
 
 type dialOptions struct {
-	channelBufferSize int  // subscribe buffer channel size
-	readBufferSize    int  // connection read buffer size
-	writeBufferSize   int  // connection write buffer size
-	enableCompression bool // enable websocket RFC7692 compress
+	channelBufferSize int                              // subscribe buffer channel size
+	readBufferSize    int                              // connection read buffer size
+	writeBufferSize   int                              // connection write buffer size
+	enableCompression bool                             // enable websocket RFC7692 compress
+	historySize       int                              // messages kept per topic
+	historyTTL        time.Duration                    // how long topic messages are kept
+	topicFramer       func(*Message) []byte            // frames topic messages sent to clients
+	resumeTimeout     time.Duration                    // how long dropped sessions wait to be resumed
+	broker            Broker                           // cross-node pub/sub backend
+	cluster           Cluster                          // cross-node request transport
+	codec             Codec                            // encodes values written with WriteValue and PublishValue
+	metrics           Metrics                          // receives the measurements of the instance
+	slowConsumer      *SlowConsumer                    // what happens when the buffer of a session is full
+	batching          *Batching                        // writes queued messages in batches
+	hubShards         int                              // number of hub shards
+	topicShards       int                              // number of pub/sub workers
+	sessionID         func(*http.Request) string       // generates the hashID of new sessions
+	clientSessionID   func(*http.Request, string) bool // validates hashIDs chosen by clients
 }
 
 // DialChannelBufferSize set ChannelBufferSize
@@ -112,6 +150,59 @@ func DialEnableCompress(isEnable bool) DialOption {
 	}}
 }
 
+// DialTopicHistory keep the last size messages published to every topic for ttl (0 keeps them
+// until overwritten), so sessions subscribing later can replay them with Session.AddSubReplay.
+func DialTopicHistory(size int, ttl time.Duration) DialOption {
+	return DialOption{func(do *dialOptions) {
+		do.historySize = size
+		do.historyTTL = ttl
+	}}
+}
+
+// DialTopicFramer frame every topic message with fn before it is sent to the subscribers,
+// e.g. JSONTopicFramer to let clients see the topic, sequence number and id of messages.
+// fn is called once per published message, not once per subscriber.
+func DialTopicFramer(fn func(*Message) []byte) DialOption {
+	return DialOption{func(do *dialOptions) {
+		do.topicFramer = fn
+	}}
+}
+
+// DialHubShards set the number of shards sessions are spread over by hashID, GOMAXPROCS by default.
+// Every shard registers its sessions and fans broadcasts out on its own goroutine, so a broadcast
+// to many sessions does not stall registrations on other shards.
+func DialHubShards(shards int) DialOption {
+	return DialOption{func(do *dialOptions) {
+		do.hubShards = shards
+	}}
+}
+
+// DialTopicShards set the number of pub/sub workers topics are partitioned over by a hash of their
+// name, GOMAXPROCS by default. Every worker publishes to its topics on its own goroutine, so
+// publishes to different topics fan out in parallel while messages of one topic keep their order.
+// Wildcard subscriptions are kept by every worker.
+func DialTopicShards(shards int) DialOption {
+	return DialOption{func(do *dialOptions) {
+		do.topicShards = shards
+	}}
+}
+
+// DialBroker set the Broker used to publish messages across nodes.
+// By default messages only reach sessions of the local melody instance.
+func DialBroker(broker Broker) DialOption {
+	return DialOption{func(do *dialOptions) {
+		do.broker = broker
+	}}
+}
+
+// DialCluster set the Cluster used to fan requests such as CloseSessions out to every node.
+// By default only the local melody instance is considered.
+func DialCluster(cluster Cluster) DialOption {
+	return DialOption{func(do *dialOptions) {
+		do.cluster = cluster
+	}}
+}
+
 // New creates a new melody instance with default Upgrader and Config.
 func New(options ...DialOption) *Melody {
 
@@ -121,6 +212,10 @@ func New(options ...DialOption) *Melody {
 		writeBufferSize:   1024,
 		readBufferSize:    1024,
 		enableCompression: false,
+		codec:             JSONCodec{},
+		metrics:           noopMetrics{},
+		hubShards:         runtime.GOMAXPROCS(0),
+		topicShards:       runtime.GOMAXPROCS(0),
 	}
 
 	for _, option := range options {
@@ -134,11 +229,11 @@ func New(options ...DialOption) *Melody {
 		EnableCompression: melodySetting.enableCompression,
 	}
 
-	hub := newHub()
+	hub := newShardedHub(melodySetting.hubShards, melodySetting.metrics)
 
 	go hub.run()
 
-	return &Melody{
+	m := &Melody{
 		Config:                   newConfig(),
 		Upgrader:                 upgrader,
 		messageHandler:           func(*Session, []byte) {},
@@ -150,16 +245,156 @@ func New(options ...DialOption) *Melody {
 		connectHandler:           func(*Session) {},
 		disconnectHandler:        func(*Session) {},
 		pongHandler:              func(*Session) {},
+		topicMessageSentHandler:  func(*Session, *Message) {},
+		resumeHandler:            func(*Session) {},
+		brokerErrorHandler:       func(error) {},
+		slowReports:              newSlowConsumerReports(),
 		hub:                      hub,
-		pubsub:                   pubSubNew(melodySetting.channelBufferSize),
+		presence:                 newPresence(),
+		router:                   newRouter(),
+		codec:                    melodySetting.codec,
+		metrics:                  melodySetting.metrics,
+		slowConsumer:             melodySetting.slowConsumer,
+		batching:                 melodySetting.batching,
+		resumeTimeout:            melodySetting.resumeTimeout,
+		sessionID:                melodySetting.sessionID,
+		clientSessionID:          melodySetting.clientSessionID,
+		parked:                   make(map[string]*parkedSession),
+		parkedMutex:              &sync.Mutex{},
 	}
+
+	m.pubsub = pubSubNew(pubSubOptions{
+		bufferSize: melodySetting.channelBufferSize,
+		history:    historyConfig{size: melodySetting.historySize, ttl: melodySetting.historyTTL},
+		framer:     melodySetting.topicFramer,
+		broker:     melodySetting.broker,
+		errorHandler: func(err error) {
+			m.brokerErrorHandler(err)
+		},
+		presence:     m.presence.push,
+		metrics:      melodySetting.metrics,
+		slowConsumer: melodySetting.slowConsumer,
+		slowConsumerHandler: func(s *Session, topic string, policy SlowConsumerPolicy) {
+			m.reportSlowConsumer(s, topic, policy)
+		},
+		shards:  melodySetting.topicShards,
+		prepare: melodySetting.batching == nil,
+	})
+
+	go m.presence.run()
+	go m.runSlowConsumerReports()
+
+	m.cluster = melodySetting.cluster
+	if m.cluster == nil {
+		m.cluster = newLocalCluster()
+	}
+	m.cluster.SetHandler(m.serveCluster)
+
+	return m
 }
 
-// CloseSessions 關閉Session，指定Key(Value相等的) Close Session if Key,Value Match
+// CloseSessions 關閉所有節點上的Session，指定Key(Value相等的) Close Session on every node if Key,Value Match
 // example: in multi server:  same user login, close session by user and keep current connection by hashID
-func (m *Melody) CloseSessions(key string, value interface{}, keepSessionHash string) {
-	message := &closesession{t: websocket.CloseMessage, key: key, value: value, keepSessionHash: keepSessionHash}
-	m.hub.closesession <- message
+// The result maps every node id to the number of sessions closed on that node.
+func (m *Melody) CloseSessions(key string, value interface{}, keepSessionHash string) (map[string]int, error) {
+	return m.CloseSessionsContext(context.Background(), key, value, keepSessionHash)
+}
+
+// CloseSessionsContext does the same as CloseSessions but stops waiting for other nodes once ctx is done.
+// Nodes which replied before ctx was done are still reported.
+func (m *Melody) CloseSessionsContext(ctx context.Context, key string, value interface{}, keepSessionHash string) (map[string]int, error) {
+	req := &ClusterRequest{Op: ClusterCloseSessions, Key: key, Value: value, KeepSessionHash: keepSessionHash}
+	responses, err := m.cluster.Broadcast(ctx, req)
+
+	result := make(map[string]int, len(responses))
+	for _, resp := range responses {
+		result[resp.NodeID] = resp.Closed
+	}
+
+	return result, err
+}
+
+// serveCluster 處理其他節點的請求 (serve a request coming from the cluster)
+func (m *Melody) serveCluster(req *ClusterRequest) *ClusterResponse {
+	resp := &ClusterResponse{NodeID: m.cluster.NodeID()}
+
+	switch req.Op {
+	case ClusterCloseSessions:
+		resp.Closed = m.closeLocalSessions(req.Key, req.Value, req.KeepSessionHash)
+	case ClusterWriteTo:
+		if s, ok := m.hub.session(req.HashID); ok {
+			resp.Written = true
+			if err := s.queue(&envelope{t: req.Type, msg: req.Data}); err != nil {
+				resp.Written = false
+				resp.Error = err.Error()
+			}
+		}
+	}
+
+	return resp
+}
+
+func (m *Melody) closeLocalSessions(key string, value interface{}, keepSessionHash string) int {
+	if m.hub.closed() {
+		return 0
+	}
+
+	message := &closesession{
+		t:               websocket.CloseMessage,
+		key:             key,
+		value:           value,
+		keepSessionHash: keepSessionHash,
+	}
+
+	return m.hub.closeSessions(message)
+}
+
+// Session returns the local session with the given hashID, see Session.GetHashID.
+func (m *Melody) Session(hashID string) (*Session, bool) {
+	return m.hub.session(hashID)
+}
+
+// WriteTo writes a text message to the session with the given hashID. Sessions of other nodes
+// are reached through the Cluster, ErrSessionNotFound is returned when no node has the session.
+func (m *Melody) WriteTo(hashID string, msg []byte) error {
+	return m.WriteToContext(context.Background(), hashID, websocket.TextMessage, msg)
+}
+
+// WriteBinaryTo writes a binary message to the session with the given hashID, see WriteTo.
+func (m *Melody) WriteBinaryTo(hashID string, msg []byte) error {
+	return m.WriteToContext(context.Background(), hashID, websocket.BinaryMessage, msg)
+}
+
+// WriteToContext writes a message of messageType to the session with the given hashID and stops
+// waiting for other nodes once ctx is done.
+func (m *Melody) WriteToContext(ctx context.Context, hashID string, messageType int, msg []byte) error {
+	if m.hub.closed() {
+		return errors.New("melody instance is closed")
+	}
+
+	if s, ok := m.hub.session(hashID); ok {
+		return s.queue(&envelope{t: messageType, msg: msg})
+	}
+
+	req := &ClusterRequest{Op: ClusterWriteTo, HashID: hashID, Type: messageType, Data: msg}
+	responses, err := m.cluster.Broadcast(ctx, req)
+	for _, resp := range responses {
+		if resp.Written && resp.Error == "" {
+			return nil
+		}
+	}
+
+	// 沒有節點寫入時才回報錯誤 (errors are only surfaced when no node delivered the message)
+	for _, resp := range responses {
+		if resp.Error != "" {
+			return errors.New(resp.Error)
+		}
+	}
+	if err != nil {
+		return err
+	}
+
+	return ErrSessionNotFound
 }
 
 // PubMsg Publish Message To Session Subscribe （向下相容）
@@ -192,6 +427,52 @@ func (m *Melody) PubBinaryMsg(msg []byte, isAsync bool, topics ...string) {
 	}
 }
 
+// PublishOptions configures PublishContext.
+type PublishOptions struct {
+	Binary bool // send a binary message instead of a text message
+	Async  bool // drop the message for subscribers whose buffer is full instead of waiting
+}
+
+// PublishContext publishes msg to every subscriber of topic and reports how many subscribers
+// of this node received it or dropped it. Subscribers of other nodes are reached through the
+// Broker and are not counted. Unless opts.Async is set, it waits for full subscriber buffers
+// until ctx is done and returns ctx.Err() if some subscribers had to be dropped.
+// It returns ErrPubSubShutdown instead of blocking once the pub/sub service is shut down.
+func (m *Melody) PublishContext(ctx context.Context, topic string, msg []byte, opts *PublishOptions) (*PublishResult, error) {
+	if opts == nil {
+		opts = &PublishOptions{}
+	}
+
+	message := &envelope{t: websocket.TextMessage, msg: msg}
+	if opts.Binary {
+		message.t = websocket.BinaryMessage
+	}
+
+	return m.pubsub.PubContext(ctx, message, opts.Async, topic)
+}
+
+// Topics returns the topics and wildcard patterns which have at least one subscriber on this node.
+func (m *Melody) Topics() []string {
+	return m.pubsub.Topics()
+}
+
+// TopicSubscribers returns the sessions of this node which receive messages published to topic,
+// including sessions subscribed through a matching wildcard pattern.
+func (m *Melody) TopicSubscribers(topic string) []*Session {
+	return m.pubsub.Subscribers(topic)
+}
+
+// TopicCount returns the number of sessions of this node which receive messages published to topic.
+func (m *Melody) TopicCount(topic string) int {
+	return len(m.pubsub.Subscribers(topic))
+}
+
+// SetTopicHistory keep the last size messages published to topic for ttl (0 keeps them until
+// overwritten), overriding DialTopicHistory. A size of 0 disables the history of topic.
+func (m *Melody) SetTopicHistory(topic string, size int, ttl time.Duration) {
+	m.pubsub.SetHistory(topic, size, ttl)
+}
+
 // HandleConnect fires fn when a session connects.
 func (m *Melody) HandleConnect(fn func(*Session)) {
 	m.connectHandler = fn
@@ -227,11 +508,23 @@ func (m *Melody) HandleSentMessageBinary(fn func(*Session, []byte)) {
 	m.messageSentHandlerBinary = fn
 }
 
-// HandleError fires fn when a session has an error.
+// HandleSentTopicMessage fires fn when a message published to a topic is successfully sent,
+// with the topic, sequence number and id of the message.
+func (m *Melody) HandleSentTopicMessage(fn func(*Session, *Message)) {
+	m.topicMessageSentHandler = fn
+}
+
+// HandleError fires fn when a session has an error. When a handler panics, err is a *PanicError
+// and the session is closed with CloseInternalServerErr.
 func (m *Melody) HandleError(fn func(*Session, error)) {
 	m.errorHandler = fn
 }
 
+// HandleBrokerError fires fn when the Broker fails to publish or (un)subscribe a topic.
+func (m *Melody) HandleBrokerError(fn func(error)) {
+	m.brokerErrorHandler = fn
+}
+
 // HandleClose sets the handler for close messages received from the session.
 // The code argument to h is the received close code or CloseNoStatusReceived
 // if the close message is empty. The default close handler sends a close frame
@@ -262,9 +555,39 @@ func (m *Melody) HandleRequestWithKeys(w http.ResponseWriter, r *http.Request, k
 		return errors.New("melody instance is closed")
 	}
 
+	if session := m.resumeRequest(r); session != nil {
+		conn, err := m.Upgrader.Upgrade(w, r, w.Header())
+
+		if err != nil {
+			m.park(session)
+			return err
+		}
+
+		session.resume(conn, r)
+
+		if err := safe(func() {
+			m.resumeHandler(session)
+		}); err != nil {
+			session.panicked(err)
+		}
+
+		return m.serve(session)
+	}
+
+	hashID, err := m.newSessionID(r)
+	if err != nil {
+		status := http.StatusBadRequest
+		if err == ErrMelodyClosed {
+			status = http.StatusServiceUnavailable
+		}
+		http.Error(w, http.StatusText(status), status)
+		return err
+	}
+
 	conn, err := m.Upgrader.Upgrade(w, r, w.Header())
 
 	if err != nil {
+		m.hub.release(hashID)
 		return err
 	}
 
@@ -273,42 +596,90 @@ func (m *Melody) HandleRequestWithKeys(w http.ResponseWriter, r *http.Request, k
 		Keys:            keys,
 		conn:            conn,
 		output:          make(chan *envelope, m.Config.MessageBufferSize),
+		control:         make(chan *envelope, m.Config.ControlBufferSize),
 		closeOutputChan: make(chan struct{}), // fix write to close output channel
+		writeDone:       make(chan struct{}),
+		done:            make(chan struct{}),
+		coalesced:       newCoalescer(),
 		melody:          m,
 		open:            true,
 		rwmutex:         &sync.RWMutex{},
 		keymutex:        &sync.RWMutex{},
-		hashID:          uuid.NewV4().String(),
-		subChan:         m.pubsub.Sub("default"),
+		rpcMutex:        &sync.Mutex{},
+		pending:         make(map[string]chan *rpcFrame),
+		hashID:          hashID,
+	}
+	session.subChan = m.pubsub.Sub(session, "default")
+
+	if m.resumeTimeout > 0 {
+		session.resumeToken = uuid.NewV4().String()
 	}
 
-	m.hub.register <- session
+	if err := m.hub.register(session); err != nil {
+		// 已關機，以關機的close frame拒絕連線 (shut down meanwhile, turn the connection away with the shutdown close frame)
+		conn.WriteControl(websocket.CloseMessage, m.hub.closeMessage(), time.Now().Add(m.Config.WriteWait))
+		conn.Close()
+		m.pubsub.Unsub(session.subChan)
+		return err
+	}
 
-	m.connectHandler(session)
+	if err := safe(func() {
+		m.dispatch(EventConnect, session, nil, m.handleConnect)
+	}); err != nil {
+		session.panicked(err)
+	}
 
+	return m.serve(session)
+}
+
+// serve 執行Session直到斷線，可重連時保留Session (run the session until its connection drops, parking it if it may be resumed)
+func (m *Melody) serve(session *Session) error {
 	go session.writePump()
 
-	session.readPump()
+	err := session.readPump()
 
-	if !m.hub.closed() {
-		m.hub.unregister <- session
+	if _, ok := err.(*PanicError); ok {
+		// 等待關閉訊息送出 (let writePump flush the close message)
+		select {
+		case <-session.writeDone:
+		case <-time.After(m.Config.WriteWait):
+		}
 	}
 
-	session.close()
+	if session.shouldPark(err) {
+		session.park()
+		m.park(session)
+		return nil
+	}
 
-	m.disconnectHandler(session)
+	m.finish(session)
 
 	return nil
 }
 
+// finish 關閉並移除Session (close and unregister the session)
+func (m *Melody) finish(session *Session) {
+	if !m.hub.closed() {
+		m.hub.unregister(session)
+	}
+
+	session.close()
+
+	if err := safe(func() {
+		m.dispatch(EventDisconnect, session, nil, m.handleDisconnect)
+	}); err != nil {
+		m.errorHandler(session, err)
+	}
+}
+
 // Broadcast broadcasts a text message to all sessions.
 func (m *Melody) Broadcast(msg []byte) error {
 	if m.hub.closed() {
 		return errors.New("melody instance is closed")
 	}
 
-	message := &envelope{t: websocket.TextMessage, msg: msg}
-	m.hub.broadcast <- message
+	message := (&envelope{t: websocket.TextMessage, msg: msg}).prepare()
+	m.hub.broadcast(message)
 
 	return nil
 }
@@ -319,8 +690,8 @@ func (m *Melody) BroadcastFilter(msg []byte, fn func(*Session) bool) error {
 		return errors.New("melody instance is closed")
 	}
 
-	message := &envelope{t: websocket.TextMessage, msg: msg, filter: fn}
-	m.hub.broadcast <- message
+	message := (&envelope{t: websocket.TextMessage, msg: msg, filter: fn}).prepare()
+	m.hub.broadcast(message)
 
 	return nil
 }
@@ -334,10 +705,12 @@ func (m *Melody) BroadcastOthers(msg []byte, s *Session) error {
 
 // BroadcastMultiple broadcasts a text message to multiple sessions given in the sessions slice.
 func (m *Melody) BroadcastMultiple(msg []byte, sessions []*Session) error {
+	message := (&envelope{t: websocket.TextMessage, msg: msg}).prepare()
 	for _, sess := range sessions {
-		if writeErr := sess.Write(msg); writeErr != nil {
-			return writeErr
+		if sess.closed() {
+			return errors.New("session is closed")
 		}
+		sess.writeMessage(message)
 	}
 	return nil
 }
@@ -348,8 +721,8 @@ func (m *Melody) BroadcastBinary(msg []byte) error {
 		return errors.New("melody instance is closed")
 	}
 
-	message := &envelope{t: websocket.BinaryMessage, msg: msg}
-	m.hub.broadcast <- message
+	message := (&envelope{t: websocket.BinaryMessage, msg: msg}).prepare()
+	m.hub.broadcast(message)
 
 	return nil
 }
@@ -360,8 +733,8 @@ func (m *Melody) BroadcastBinaryFilter(msg []byte, fn func(*Session) bool) error
 		return errors.New("melody instance is closed")
 	}
 
-	message := &envelope{t: websocket.BinaryMessage, msg: msg, filter: fn}
-	m.hub.broadcast <- message
+	message := (&envelope{t: websocket.BinaryMessage, msg: msg, filter: fn}).prepare()
+	m.hub.broadcast(message)
 
 	return nil
 }
@@ -379,7 +752,7 @@ func (m *Melody) Close() error {
 		return errors.New("melody instance is already closed")
 	}
 
-	m.hub.exit <- &envelope{t: websocket.CloseMessage, msg: []byte{}}
+	m.hub.exit(&envelope{t: websocket.CloseMessage, msg: []byte{}})
 
 	return nil
 }
@@ -391,7 +764,7 @@ func (m *Melody) CloseWithMsg(msg []byte) error {
 		return errors.New("melody instance is already closed")
 	}
 
-	m.hub.exit <- &envelope{t: websocket.CloseMessage, msg: msg}
+	m.hub.exit(&envelope{t: websocket.CloseMessage, msg: msg})
 
 	return nil
 }
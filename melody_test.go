@@ -2,11 +2,18 @@ package melody
 
 import (
 	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
 	"math/rand"
 	"net/http"
 	"net/http/httptest"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"testing/quick"
 	"time"
@@ -680,6 +687,1488 @@ func TestPong(t *testing.T) {
 	}
 }
 
+type fakeBrokerNetwork struct {
+	mutex sync.Mutex
+	nodes map[*fakeBroker]map[string]bool
+}
+
+type fakeBroker struct {
+	network *fakeBrokerNetwork
+	handler func(*BrokerMessage)
+}
+
+func newFakeBrokerNetwork() *fakeBrokerNetwork {
+	return &fakeBrokerNetwork{nodes: make(map[*fakeBroker]map[string]bool)}
+}
+
+func (n *fakeBrokerNetwork) node() *fakeBroker {
+	b := &fakeBroker{network: n}
+	n.mutex.Lock()
+	n.nodes[b] = make(map[string]bool)
+	n.mutex.Unlock()
+	return b
+}
+
+func (b *fakeBroker) SetHandler(fn func(*BrokerMessage)) {
+	b.handler = fn
+}
+
+func (b *fakeBroker) Publish(msg *BrokerMessage) error {
+	var receivers []*fakeBroker
+	b.network.mutex.Lock()
+	for node, topics := range b.network.nodes {
+		if topics[msg.Topic] {
+			receivers = append(receivers, node)
+		}
+	}
+	b.network.mutex.Unlock()
+
+	for _, node := range receivers {
+		node.handler(msg)
+	}
+	return nil
+}
+
+func (b *fakeBroker) Subscribe(topic string) error {
+	b.network.mutex.Lock()
+	defer b.network.mutex.Unlock()
+	b.network.nodes[b][topic] = true
+	return nil
+}
+
+func (b *fakeBroker) Unsubscribe(topic string) error {
+	b.network.mutex.Lock()
+	defer b.network.mutex.Unlock()
+	delete(b.network.nodes[b], topic)
+	return nil
+}
+
+func (b *fakeBroker) Close() error {
+	b.network.mutex.Lock()
+	defer b.network.mutex.Unlock()
+	delete(b.network.nodes, b)
+	return nil
+}
+
+func TestBrokerPublishAcrossNodes(t *testing.T) {
+	network := newFakeBrokerNetwork()
+	nodeA := New(DialBroker(network.node()))
+	nodeB := New(DialBroker(network.node()))
+
+	subscribed := make(chan bool)
+	nodeB.HandleConnect(func(s *Session) {
+		s.AddSub("news")
+		subscribed <- true
+	})
+	server := httptest.NewServer(&TestServer{m: nodeB})
+	defer server.Close()
+
+	conn, err := NewDialer(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	<-subscribed
+	for nodeB.TopicCount("news") == 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	nodeA.PubTextMsg([]byte("from node a"), false, "news")
+
+	_, ret, err := conn.ReadMessage()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if string(ret) != "from node a" {
+		t.Errorf("%s should equal from node a", string(ret))
+	}
+}
+
+func TestCloseSessionsAcrossNodes(t *testing.T) {
+	cluster := NewMemoryCluster()
+	nodeA := New(DialCluster(cluster.Node("a")))
+	nodeB := New(DialCluster(cluster.Node("b")))
+
+	connected := make(chan *Session)
+	for _, node := range []*Melody{nodeA, nodeB} {
+		node.HandleConnect(func(s *Session) {
+			s.Set("userID", 42)
+			connected <- s
+		})
+	}
+
+	serverA := httptest.NewServer(&TestServer{m: nodeA})
+	defer serverA.Close()
+	serverB := httptest.NewServer(&TestServer{m: nodeB})
+	defer serverB.Close()
+
+	stale, err := NewDialer(serverA.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stale.Close()
+	<-connected
+
+	current, err := NewDialer(serverB.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer current.Close()
+	keep := <-connected
+
+	result, err := nodeB.CloseSessions("userID", 42, keep.GetHashID())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if result["a"] != 1 || result["b"] != 0 {
+		t.Errorf("closed sessions %v should be a:1 b:0", result)
+	}
+
+	if _, _, err := stale.ReadMessage(); err == nil {
+		t.Error("stale session should be closed")
+	}
+}
+
+func TestPublishContext(t *testing.T) {
+	ps := pubSubNew(pubSubOptions{bufferSize: 1})
+	ps.Sub(nil, "ticks")
+
+	msg := &envelope{t: websocket.TextMessage, msg: []byte("tick")}
+	result, err := ps.PubContext(context.Background(), msg, false, "ticks")
+	if err != nil || result.Delivered != 1 || result.Dropped != 0 {
+		t.Errorf("first publish should be delivered, got %+v %v", result, err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	result, err = ps.PubContext(ctx, msg, false, "ticks")
+	if err != context.DeadlineExceeded || result.Dropped != 1 {
+		t.Errorf("full subscriber should be dropped on timeout, got %+v %v", result, err)
+	}
+
+	ps.Shutdown()
+	if _, err := ps.PubContext(context.Background(), msg, false, "ticks"); err != ErrPubSubShutdown {
+		t.Errorf("publish after shutdown should return %v, got %v", ErrPubSubShutdown, err)
+	}
+}
+
+func TestTopicTrie(t *testing.T) {
+	trie := newTopicTrie()
+	for _, pattern := range []string{"quotes.us.*", "quotes.>", "quotes.*.AAPL", "news.>"} {
+		trie.insert(pattern)
+	}
+
+	cases := map[string][]string{
+		"quotes.us.AAPL":     {"quotes.*.AAPL", "quotes.>", "quotes.us.*"},
+		"quotes.us.AAPL.bid": {"quotes.>"},
+		"quotes":             nil,
+		"news":               nil,
+		"news.sport":         {"news.>"},
+	}
+
+	for topic, expected := range cases {
+		patterns := trie.match(topic)
+		sort.Strings(patterns)
+		if strings.Join(patterns, ",") != strings.Join(expected, ",") {
+			t.Errorf("%s should match %v, got %v", topic, expected, patterns)
+		}
+	}
+
+	trie.remove("quotes.>")
+	trie.remove("news.>")
+	if patterns := trie.match("quotes.us.AAPL.bid"); len(patterns) != 0 {
+		t.Errorf("removed pattern should not match, got %v", patterns)
+	}
+	if _, ok := trie.children["news"]; ok {
+		t.Error("empty branches should be pruned")
+	}
+}
+
+func TestWildcardSubscribe(t *testing.T) {
+	ps := pubSubNew(pubSubOptions{bufferSize: 10})
+	ch := ps.Sub(nil, "quotes.us.*", "quotes.>")
+
+	msg := &envelope{t: websocket.TextMessage, msg: []byte("150.1")}
+	result, _ := ps.PubContext(context.Background(), msg, false, "quotes.us.AAPL")
+	if result.Delivered != 1 {
+		t.Errorf("channel matching two patterns should receive the message once, got %d", result.Delivered)
+	}
+
+	result, _ = ps.PubContext(context.Background(), msg, false, "news.us")
+	if result.Delivered != 0 || len(ch) != 1 {
+		t.Errorf("unrelated topic should not be delivered, got %d", result.Delivered)
+	}
+}
+
+func TestTopicIntrospection(t *testing.T) {
+	ts := NewTestServer()
+	connected := make(chan *Session)
+	ts.m.HandleConnect(func(s *Session) {
+		s.AddSub("room.1", "room.*")
+		connected <- s
+	})
+	server := httptest.NewServer(ts)
+	defer server.Close()
+
+	conn, err := NewDialer(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	s := <-connected
+
+	if topics := strings.Join(s.Topics(), ","); topics != "default,room.*,room.1" {
+		t.Errorf("session topics should be default,room.*,room.1, got %s", topics)
+	}
+
+	if topics := strings.Join(ts.m.Topics(), ","); topics != "default,room.*,room.1" {
+		t.Errorf("melody topics should be default,room.*,room.1, got %s", topics)
+	}
+
+	subscribers := ts.m.TopicSubscribers("room.2")
+	if len(subscribers) != 1 || subscribers[0] != s {
+		t.Errorf("room.2 should be received by the wildcard subscriber, got %v", subscribers)
+	}
+
+	if ts.m.TopicCount("lobby") != 0 {
+		t.Error("lobby should have no subscribers")
+	}
+}
+
+func TestTopicHistoryReplay(t *testing.T) {
+	ps := pubSubNew(pubSubOptions{bufferSize: 10, history: historyConfig{size: 3}})
+	for i := 1; i <= 5; i++ {
+		ps.PubContext(context.Background(), &envelope{t: websocket.TextMessage, msg: []byte(strconv.Itoa(i))}, false, "chat.1")
+	}
+
+	read := func(ch chan *envelope) string {
+		var msgs []string
+		for len(ch) > 0 {
+			msgs = append(msgs, string((<-ch).msg))
+		}
+		return strings.Join(msgs, ",")
+	}
+
+	last := ps.Sub(nil)
+	ps.AddSubReplay(last, &Replay{Last: 2}, "chat.1")
+	ps.Topics() // wait for the subscription to be processed
+	if msgs := read(last); msgs != "4,5" {
+		t.Errorf("last 2 messages should be 4,5, got %s", msgs)
+	}
+
+	since := ps.Sub(nil)
+	ps.AddSubReplay(since, &Replay{Since: 3}, "chat.*")
+	ps.Topics()
+	if msgs := read(since); msgs != "4,5" {
+		t.Errorf("messages after sequence 3 should be 4,5, got %s", msgs)
+	}
+
+	ps.SetHistory("chat.1", 3, time.Millisecond)
+	time.Sleep(5 * time.Millisecond)
+	expired := ps.Sub(nil)
+	ps.AddSubReplay(expired, &Replay{Last: 3}, "chat.1")
+	ps.Topics()
+	if msgs := read(expired); msgs != "" {
+		t.Errorf("expired messages should not be replayed, got %s", msgs)
+	}
+}
+
+func TestTopicHistoryReplayShards(t *testing.T) {
+	ps := pubSubNew(pubSubOptions{bufferSize: 20, history: historyConfig{size: 5}, shards: 8})
+	for i := 1; i <= 20; i++ {
+		topic := "q." + strconv.Itoa(i%5)
+		ps.PubContext(context.Background(), &envelope{t: websocket.TextMessage, msg: []byte(strconv.Itoa(i))}, false, topic)
+	}
+
+	ch := ps.Sub(nil)
+	ps.AddSubReplay(ch, &Replay{Last: 3}, "q.*")
+
+	var msgs []string
+	for len(ch) > 0 {
+		msgs = append(msgs, string((<-ch).msg))
+	}
+	if got := strings.Join(msgs, ","); got != "18,19,20" {
+		t.Errorf("the last 3 messages of every partition should be 18,19,20, got %s", got)
+	}
+}
+
+func TestTopicHistoryReplayNegativeLast(t *testing.T) {
+	ps := pubSubNew(pubSubOptions{bufferSize: 10, history: historyConfig{size: 3}})
+	ps.PubContext(context.Background(), &envelope{t: websocket.TextMessage, msg: []byte("1")}, false, "chat.1")
+
+	for _, topic := range []string{"chat.1", "chat.*"} {
+		ch := ps.Sub(nil)
+		ps.AddSubReplay(ch, &Replay{Last: -1}, topic)
+		ps.Topics() // the worker would have panicked before answering
+		if len(ch) != 0 {
+			t.Errorf("a negative Last should replay nothing on %s, got %d messages", topic, len(ch))
+		}
+	}
+}
+
+func TestTopicSequenceForgotten(t *testing.T) {
+	ps := pubSubNew(pubSubOptions{bufferSize: 10})
+	ps.SetHistory("kept", 2, 0)
+	seqs := func() map[string]uint64 {
+		all := make(map[string]uint64)
+		ps.read(func(reg *register) {
+			for topic, seq := range reg.seqs {
+				all[topic] = seq
+			}
+		})
+		return all
+	}
+	publish := func(topic string) {
+		ps.PubContext(context.Background(), &envelope{t: websocket.TextMessage, msg: []byte(topic)}, false, topic)
+	}
+
+	for i := 0; i < 100; i++ {
+		publish("once." + strconv.Itoa(i))
+	}
+	direct := ps.Sub(nil, "chat")
+	wildcard := ps.Sub(nil, "room.*")
+	for i := 0; i < 2; i++ {
+		publish("chat")
+		publish("room.1")
+		publish("kept")
+	}
+
+	if got := seqs(); len(got) != 3 || got["chat"] != 2 || got["room.1"] != 2 || got["kept"] != 2 {
+		t.Errorf("only topics with subscribers or history should keep a sequence, got %v", got)
+	}
+
+	ps.Unsub(direct, "chat")
+	ps.Unsub(wildcard, "room.*")
+	if got := seqs(); len(got) != 1 || got["kept"] != 2 {
+		t.Errorf("sequences should be dropped with the last subscriber, got %v", got)
+	}
+
+	ps.SetHistory("kept", 0, 0)
+	if got := seqs(); len(got) != 0 {
+		t.Errorf("sequence should be dropped with the history, got %v", got)
+	}
+}
+
+func TestTopicMessageSequence(t *testing.T) {
+	ts := &TestServer{m: New(DialTopicFramer(JSONTopicFramer))}
+	subscribed := make(chan bool)
+	ts.m.HandleConnect(func(s *Session) {
+		s.AddSub("chat")
+		subscribed <- true
+	})
+	sent := make(chan *Message, 2)
+	ts.m.HandleSentTopicMessage(func(s *Session, msg *Message) {
+		sent <- msg
+	})
+	server := httptest.NewServer(ts)
+	defer server.Close()
+
+	conn, err := NewDialer(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	<-subscribed
+
+	ts.m.PubTextMsg([]byte(`{"text":"hi"}`), false, "chat")
+	ts.m.PubTextMsg([]byte("plain"), false, "chat")
+
+	for i, data := range []string{`{"text":"hi"}`, `"plain"`} {
+		var frame struct {
+			Topic string          `json:"topic"`
+			Seq   uint64          `json:"seq"`
+			ID    string          `json:"id"`
+			Data  json.RawMessage `json:"data"`
+		}
+		if err := conn.ReadJSON(&frame); err != nil {
+			t.Fatal(err)
+		}
+
+		msg := <-sent
+		if frame.Topic != "chat" || frame.Seq != uint64(i+1) || string(frame.Data) != data {
+			t.Errorf("frame %d should be chat #%d %s, got %+v", i, i+1, data, frame)
+		}
+		if frame.ID == "" || frame.ID != msg.ID || msg.Seq != frame.Seq {
+			t.Errorf("sent hook %+v should match frame %+v", msg, frame)
+		}
+	}
+}
+
+func TestResumeSession(t *testing.T) {
+	ts := &TestServer{m: New(DialResumeTimeout(time.Second))}
+	ts.m.HandleConnect(func(s *Session) {
+		s.AddSub("room")
+		s.Write([]byte(s.ResumeToken()))
+	})
+	resumed := make(chan *Session, 1)
+	ts.m.HandleResume(func(s *Session) {
+		resumed <- s
+	})
+	server := httptest.NewServer(ts)
+	defer server.Close()
+
+	conn, err := NewDialer(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, token, err := conn.ReadMessage()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// drop the connection without a close frame and wait for the session to be parked
+	conn.UnderlyingConn().Close()
+	for {
+		ts.m.parkedMutex.Lock()
+		_, parked := ts.m.parked[string(token)]
+		ts.m.parkedMutex.Unlock()
+		if parked {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	ts.m.PubTextMsg([]byte("missed"), false, "room")
+
+	conn, err = NewDialer(server.URL + "?" + ResumeTokenParam + "=" + string(token))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	_, ret, err := conn.ReadMessage()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if string(ret) != "missed" {
+		t.Errorf("%s should equal missed", string(ret))
+	}
+
+	s := <-resumed
+	if topics := strings.Join(s.Topics(), ","); topics != "default,room" {
+		t.Errorf("resumed session should keep its topics, got %s", topics)
+	}
+}
+
+func TestPresence(t *testing.T) {
+	ts := NewTestServer()
+	ts.m.HandleConnect(func(s *Session) {
+		s.Set("userID", 7)
+		s.AddSub("room.1")
+	})
+	joined := make(chan string, 1)
+	left := make(chan string, 1)
+	ts.m.HandleJoin("room.*", func(s *Session, topic string) {
+		joined <- topic
+	})
+	ts.m.HandleLeave("room.*", func(s *Session, topic string) {
+		left <- topic
+	})
+	server := httptest.NewServer(ts)
+	defer server.Close()
+
+	conn, err := NewDialer(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if topic := <-joined; topic != "room.1" {
+		t.Errorf("join should fire for room.1, got %s", topic)
+	}
+
+	if members := ts.m.Presence("room.1"); len(members) != 1 {
+		t.Errorf("room.1 should have 1 member, got %d", len(members))
+	}
+
+	if keys := ts.m.PresenceKeys("room.1", "userID"); len(keys) != 1 || keys[0] != 7 {
+		t.Errorf("room.1 user ids should be [7], got %v", keys)
+	}
+
+	conn.Close()
+
+	if topic := <-left; topic != "room.1" {
+		t.Errorf("leave should fire for room.1 on disconnect, got %s", topic)
+	}
+}
+
+func TestRequestResponse(t *testing.T) {
+	ts := NewTestServer()
+	ts.m.HandleRequestMessage(func(s *Session, payload []byte) ([]byte, error) {
+		if string(payload) == `"fail"` {
+			return nil, errors.New("failed")
+		}
+		return payload, nil
+	})
+	replies := make(chan string, 1)
+	ts.m.HandleConnect(func(s *Session) {
+		go func() {
+			ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+			defer cancel()
+			resp, err := s.SendRequest(ctx, []byte(`{"ping":1}`))
+			if err != nil {
+				replies <- err.Error()
+				return
+			}
+			replies <- string(resp)
+		}()
+	})
+	server := httptest.NewServer(ts)
+	defer server.Close()
+
+	conn, err := NewDialer(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	// answer the request of the server
+	var req rpcFrame
+	if err := conn.ReadJSON(&req); err != nil {
+		t.Fatal(err)
+	}
+	if req.RPC != rpcRequest || string(req.Data) != `{"ping":1}` {
+		t.Errorf("unexpected request %+v", req)
+	}
+	conn.WriteJSON(rpcFrame{RPC: rpcResponse, ID: req.ID, Data: json.RawMessage(`"pong"`)})
+
+	if reply := <-replies; reply != `"pong"` {
+		t.Errorf("server should receive \"pong\", got %s", reply)
+	}
+
+	// request the server
+	for payload, expected := range map[string]rpcFrame{
+		`{"a":1}`: {RPC: rpcResponse, ID: "1", Data: json.RawMessage(`{"a":1}`)},
+		`"fail"`:  {RPC: rpcResponse, ID: "1", Error: "failed"},
+	} {
+		conn.WriteJSON(rpcFrame{RPC: rpcRequest, ID: "1", Data: json.RawMessage(payload)})
+
+		var resp rpcFrame
+		if err := conn.ReadJSON(&resp); err != nil {
+			t.Fatal(err)
+		}
+		if resp.ID != expected.ID || string(resp.Data) != string(expected.Data) || resp.Error != expected.Error {
+			t.Errorf("response should be %+v, got %+v", expected, resp)
+		}
+	}
+}
+
+type joinReq struct {
+	Room string `json:"room"`
+}
+
+type joinResp struct {
+	Joined string `json:"joined"`
+}
+
+func TestRouter(t *testing.T) {
+	ts := NewTestServer()
+	ts.m.On("join", func(s *Session, req joinReq) (joinResp, error) {
+		if req.Room == "" {
+			return joinResp{}, errors.New("room is required")
+		}
+		return joinResp{Joined: req.Room}, nil
+	})
+	unknown := make(chan string, 1)
+	ts.m.OnUnknown(func(s *Session, event string, data []byte) {
+		unknown <- event
+	})
+	server := httptest.NewServer(ts)
+	defer server.Close()
+
+	conn, err := NewDialer(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	for msg, expected := range map[string]string{
+		`{"event":"join","data":{"room":"lobby"}}`: `{"event":"join","data":{"joined":"lobby"}}`,
+		`{"event":"join","data":{}}`:               `{"event":"join","error":"room is required"}`,
+	} {
+		conn.WriteMessage(websocket.TextMessage, []byte(msg))
+
+		_, ret, err := conn.ReadMessage()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(ret) != expected {
+			t.Errorf("%s should be answered with %s, got %s", msg, expected, string(ret))
+		}
+	}
+
+	// 解碼錯誤的訊息由標準函式庫決定，只檢查有回報錯誤 (the decode error text comes from the stdlib, only check one is reported)
+	conn.WriteMessage(websocket.TextMessage, []byte(`{"event":"join","data":[]}`))
+	_, ret, err := conn.ReadMessage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var reply jsonEventFrame
+	if err := json.Unmarshal(ret, &reply); err != nil || reply.Event != "join" || reply.Error == "" {
+		t.Errorf("undecodable data should be answered with a join error, got %s", string(ret))
+	}
+
+	conn.WriteMessage(websocket.TextMessage, []byte(`{"event":"leave"}`))
+	if event := <-unknown; event != "leave" {
+		t.Errorf("fallback should receive leave, got %s", event)
+	}
+}
+
+func TestRouterRejectsBadHandler(t *testing.T) {
+	defer func() {
+		if recover() == nil {
+			t.Error("registering a handler without a session argument should panic")
+		}
+	}()
+
+	New().On("join", func(req joinReq) {})
+}
+
+// countingCodec 計算編碼次數的二進位Codec (binary codec counting how often it marshals)
+type countingCodec struct {
+	JSONCodec
+	marshals int32
+}
+
+func (c *countingCodec) Marshal(v interface{}) ([]byte, error) {
+	atomic.AddInt32(&c.marshals, 1)
+	return c.JSONCodec.Marshal(v)
+}
+
+func (c *countingCodec) MessageType() int {
+	return websocket.BinaryMessage
+}
+
+func TestCodec(t *testing.T) {
+	c := &countingCodec{}
+	ts := &TestServer{m: New(DialCodec(c))}
+	connected := make(chan struct{}, 2)
+	ts.m.HandleConnect(func(s *Session) {
+		s.AddSub("news")
+		s.WriteJSON(map[string]string{"hello": "json"})
+		connected <- struct{}{}
+	})
+	server := httptest.NewServer(ts)
+	defer server.Close()
+
+	var conns []*websocket.Conn
+	for i := 0; i < 2; i++ {
+		conn, err := NewDialer(server.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		conns = append(conns, conn)
+		<-connected
+	}
+
+	if err := ts.m.PublishValue("news", map[string]int{"n": 1}); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, conn := range conns {
+		messageType, ret, err := conn.ReadMessage()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if messageType != websocket.TextMessage || string(ret) != `{"hello":"json"}` {
+			t.Errorf("WriteJSON should send a text message, got %d %s", messageType, string(ret))
+		}
+
+		messageType, ret, err = conn.ReadMessage()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if messageType != websocket.BinaryMessage || string(ret) != `{"n":1}` {
+			t.Errorf("PublishValue should send a binary message, got %d %s", messageType, string(ret))
+		}
+	}
+
+	if marshals := atomic.LoadInt32(&c.marshals); marshals != 1 {
+		t.Errorf("PublishValue should encode once, encoded %d times", marshals)
+	}
+}
+
+func TestMiddleware(t *testing.T) {
+	ts := NewTestServerHandler(func(session *Session, msg []byte) {
+		session.Write(msg)
+	})
+	var mutex sync.Mutex
+	var trace []string
+	disconnected := make(chan struct{})
+	ts.m.Use(func(e *Event) {
+		mutex.Lock()
+		trace = append(trace, "first:"+e.Kind.String())
+		mutex.Unlock()
+		e.Next()
+		mutex.Lock()
+		trace = append(trace, "after:"+e.Kind.String())
+		mutex.Unlock()
+		if e.Kind == EventDisconnect {
+			close(disconnected)
+		}
+	}, func(e *Event) {
+		if e.Kind != EventMessage {
+			return
+		}
+		if string(e.Message) == "secret" {
+			e.Abort()
+			return
+		}
+		e.Message = bytes.ToUpper(e.Message)
+	})
+	server := httptest.NewServer(ts)
+	defer server.Close()
+
+	conn, err := NewDialer(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	conn.WriteMessage(websocket.TextMessage, []byte("secret"))
+	conn.WriteMessage(websocket.TextMessage, []byte("hello"))
+
+	_, ret, err := conn.ReadMessage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(ret) != "HELLO" {
+		t.Errorf("middleware should rewrite the message and abort secret, got %s", string(ret))
+	}
+
+	conn.Close()
+	<-disconnected
+
+	mutex.Lock()
+	defer mutex.Unlock()
+	expected := []string{
+		"first:connect", "after:connect",
+		"first:message", "after:message",
+		"first:message", "after:message",
+		"first:disconnect", "after:disconnect",
+	}
+	if strings.Join(trace, ",") != strings.Join(expected, ",") {
+		t.Errorf("middleware should run in order, got %v", trace)
+	}
+}
+
+func TestPanicRecovery(t *testing.T) {
+	ts := NewTestServerHandler(func(session *Session, msg []byte) {
+		panic("boom")
+	})
+	errs := make(chan error, 1)
+	ts.m.HandleError(func(s *Session, err error) {
+		if _, ok := err.(*PanicError); ok {
+			errs <- err
+		}
+	})
+	disconnected := make(chan struct{})
+	ts.m.HandleDisconnect(func(s *Session) {
+		close(disconnected)
+	})
+	server := httptest.NewServer(ts)
+	defer server.Close()
+
+	conn, err := NewDialer(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	conn.WriteMessage(websocket.TextMessage, []byte("hello"))
+
+	panicErr := (<-errs).(*PanicError)
+	if panicErr.Value != "boom" || len(panicErr.Stack) == 0 {
+		t.Errorf("PanicError should carry the value and the stack, got %v", panicErr)
+	}
+
+	_, _, err = conn.ReadMessage()
+	if !websocket.IsCloseError(err, CloseInternalServerErr) {
+		t.Errorf("session should be closed with 1011, got %v", err)
+	}
+
+	<-disconnected
+}
+
+func TestPrometheusMetrics(t *testing.T) {
+	metrics := NewPrometheusMetrics("melody")
+	ts := &TestServer{m: New(DialMetrics(metrics))}
+	ts.m.HandleMessage(func(session *Session, msg []byte) {
+		session.Write(msg)
+	})
+	server := httptest.NewServer(ts)
+	defer server.Close()
+
+	conn, err := NewDialer(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	conn.WriteMessage(websocket.TextMessage, []byte("hello"))
+	if _, _, err := conn.ReadMessage(); err != nil {
+		t.Fatal(err)
+	}
+
+	metrics.PingRTT(3 * time.Millisecond)
+
+	rec := httptest.NewRecorder()
+	metrics.ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	body := rec.Body.String()
+
+	for _, line := range []string{
+		"# TYPE melody_messages_received_total counter",
+		`melody_messages_received_total{type="text"} 1`,
+		`melody_messages_received_bytes_total{type="text"} 5`,
+		`melody_topic_subscribers{topic="default"} 1`,
+		`melody_ping_rtt_seconds_bucket{le="0.001"} 0`,
+		`melody_ping_rtt_seconds_bucket{le="0.005"} 1`,
+		"melody_ping_rtt_seconds_count 1",
+	} {
+		if !strings.Contains(body, line+"\n") {
+			t.Errorf("metrics should contain %s, got\n%s", line, body)
+		}
+	}
+}
+
+func TestShutdown(t *testing.T) {
+	ts := NewTestServer()
+	connected := make(chan *Session, 1)
+	ts.m.HandleConnect(func(s *Session) {
+		connected <- s
+	})
+	server := httptest.NewServer(ts)
+	defer server.Close()
+
+	conn, err := NewDialer(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	session := <-connected
+	session.Write([]byte("bye"))
+
+	read := make(chan error, 1)
+	go func() {
+		_, ret, err := conn.ReadMessage()
+		if err != nil || string(ret) != "bye" {
+			read <- fmt.Errorf("queued message should be delivered, got %s %v", ret, err)
+			return
+		}
+		_, _, err = conn.ReadMessage()
+		read <- err
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := ts.m.ShutdownWithMsg(ctx, FormatCloseMessage(CloseServiceRestart, "")); err != nil {
+		t.Errorf("shutdown should finish the close handshake, got %v", err)
+	}
+
+	if err := <-read; !websocket.IsCloseError(err, CloseServiceRestart) {
+		t.Errorf("client should receive 1012, got %v", err)
+	}
+
+	if _, err := NewDialer(server.URL); err == nil {
+		t.Error("new connections should be refused after shutdown")
+	}
+
+	if err := ts.m.Shutdown(ctx); err == nil {
+		t.Error("second shutdown should fail")
+	}
+}
+
+func TestShutdownDeadline(t *testing.T) {
+	ts := NewTestServer()
+	disconnected := make(chan struct{})
+	ts.m.HandleDisconnect(func(s *Session) {
+		close(disconnected)
+	})
+	server := httptest.NewServer(ts)
+	defer server.Close()
+
+	// 不讀取的client不會完成關閉握手 (a client which never reads never answers the close handshake)
+	conn, err := NewDialer(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	for ts.m.Len() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := ts.m.Shutdown(ctx); err != context.DeadlineExceeded {
+		t.Errorf("shutdown should give up at the deadline, got %v", err)
+	}
+
+	<-disconnected
+}
+
+func TestShutdownPendingUpgrade(t *testing.T) {
+	ts := NewTestServer()
+	entered := make(chan struct{})
+	release := make(chan struct{})
+	ts.m.Upgrader.CheckOrigin = func(r *http.Request) bool {
+		close(entered)
+		<-release
+		return true
+	}
+	handled := make(chan error, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		handled <- ts.m.HandleRequest(w, r)
+	}))
+	defer server.Close()
+
+	dialed := make(chan *websocket.Conn, 1)
+	go func() {
+		conn, _ := NewDialer(server.URL)
+		dialed <- conn
+	}()
+
+	<-entered
+	if err := ts.m.Shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	close(release)
+
+	if err := <-handled; err != ErrMelodyClosed {
+		t.Errorf("upgrade after shutdown should return ErrMelodyClosed, got %v", err)
+	}
+
+	conn := <-dialed
+	if conn == nil {
+		t.Fatal("upgrade should complete before being closed")
+	}
+	defer conn.Close()
+	if _, _, err := conn.ReadMessage(); !websocket.IsCloseError(err, websocket.CloseGoingAway) {
+		t.Errorf("connection should be closed with the shutdown close frame, got %v", err)
+	}
+}
+
+func TestSlowConsumerPolicies(t *testing.T) {
+	fired := make(chan string, 2)
+	ps := pubSubNew(pubSubOptions{
+		bufferSize:   1,
+		slowConsumer: &SlowConsumer{Policy: DropOldest},
+		slowConsumerHandler: func(s *Session, topic string, policy SlowConsumerPolicy) {
+			fired <- topic + ":" + policy.String()
+		},
+	})
+	defer ps.Shutdown()
+
+	ticks := ps.Sub(nil, "ticks")
+	for _, tick := range []string{"1", "2"} {
+		result, _ := ps.PubContext(context.Background(), &envelope{t: websocket.TextMessage, msg: []byte(tick)}, true, "ticks")
+		if result.Delivered != 1 {
+			t.Errorf("drop oldest should make room for tick %s, got %+v", tick, result)
+		}
+	}
+	if msg := <-ticks; string(msg.msg) != "2" {
+		t.Errorf("oldest tick should be dropped, got %s", string(msg.msg))
+	}
+	if policy := <-fired; policy != "ticks:drop_oldest" {
+		t.Errorf("drop oldest should be reported, got %s", policy)
+	}
+
+	ps.SetSlowConsumer("orders", SlowConsumer{Policy: BlockWithTimeout, Timeout: 10 * time.Millisecond})
+	ps.Sub(nil, "orders")
+	msg := &envelope{t: websocket.TextMessage, msg: []byte("order")}
+	ps.PubContext(context.Background(), msg, false, "orders")
+	start := time.Now()
+	result, _ := ps.PubContext(context.Background(), msg, false, "orders")
+	if result.Dropped != 1 || time.Since(start) > time.Second {
+		t.Errorf("full subscriber should be dropped after the timeout, got %+v", result)
+	}
+	if policy := <-fired; policy != "orders:block_with_timeout" {
+		t.Errorf("block with timeout should be reported, got %s", policy)
+	}
+
+	output := make(chan *envelope, 1)
+	output <- &envelope{t: websocket.CloseMessage}
+	if overflow(output, nil, &envelope{t: websocket.TextMessage}, SlowConsumer{Policy: DropOldest}) {
+		t.Error("drop oldest should drop the new message instead of a queued close frame")
+	}
+	if queued := <-output; queued.t != websocket.CloseMessage {
+		t.Errorf("close frame should stay queued, got type %d", queued.t)
+	}
+
+	done := make(chan bool)
+	go func() {
+		done <- overflow(make(chan *envelope), nil, &envelope{t: websocket.TextMessage}, SlowConsumer{Policy: DropOldest})
+	}()
+	select {
+	case kept := <-done:
+		if kept {
+			t.Error("drop oldest should drop the new message of an unbuffered channel")
+		}
+	case <-time.After(time.Second):
+		t.Error("drop oldest should not spin on an unbuffered channel")
+	}
+
+	m := New()
+	for i := 0; i < 10; i++ {
+		m.reportSlowConsumer(nil, "", DropNewest)
+	}
+	if len(m.slowReports.queue) != 0 {
+		t.Errorf("reports should be skipped without a handler, got %d queued", len(m.slowReports.queue))
+	}
+}
+
+func TestSlowConsumerCoalesce(t *testing.T) {
+	ps := pubSubNew(pubSubOptions{bufferSize: 1})
+	defer ps.Shutdown()
+
+	ps.SetSlowConsumer("prices", SlowConsumer{Policy: Coalesce, Key: func(msg *Message) string {
+		return strings.SplitN(string(msg.Data), "=", 2)[0]
+	}})
+	owner := &Session{coalesced: newCoalescer()}
+	ch := ps.Sub(owner, "prices")
+	for _, price := range []string{"a=1", "a=2", "b=1", "a=3", "b=2"} {
+		ps.PubContext(context.Background(), &envelope{t: websocket.TextMessage, msg: []byte(price)}, true, "prices")
+	}
+
+	if queued := <-ch; string(queued.msg) != "a=1" {
+		t.Errorf("first price should stay queued, got %s", string(queued.msg))
+	}
+	var latest []string
+	for _, msg := range owner.takeCoalesced() {
+		latest = append(latest, string(msg.msg))
+	}
+	sort.Strings(latest)
+	if got := strings.Join(latest, ","); got != "a=3,b=2" {
+		t.Errorf("only the latest price per key should be kept, got %s", got)
+	}
+}
+
+func TestSlowConsumerDisconnect(t *testing.T) {
+	ts := &TestServer{m: New(DialSlowConsumer(SlowConsumer{Policy: Disconnect}))}
+	ts.m.Config.MessageBufferSize = 1
+	ts.m.HandleConnect(func(s *Session) {
+		// writePump 尚未啟動，第二則訊息放不進緩衝區 (writePump has not started yet, the second message does not fit)
+		s.Write([]byte("1"))
+		s.Write([]byte("2"))
+	})
+	reported := make(chan error, 1)
+	ts.m.HandleError(func(s *Session, err error) {
+		if err == ErrSlowConsumer {
+			reported <- err
+		}
+	})
+	server := httptest.NewServer(ts)
+	defer server.Close()
+
+	conn, err := NewDialer(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	select {
+	case <-reported:
+	case <-time.After(time.Second):
+		t.Error("disconnecting a slow consumer should report ErrSlowConsumer")
+	}
+
+	for {
+		if _, _, err = conn.ReadMessage(); err != nil {
+			break
+		}
+	}
+	if !websocket.IsCloseError(err, ClosePolicyViolation) {
+		t.Errorf("slow consumer should be closed with 1008, got %v", err)
+	}
+}
+
+func TestWritePriority(t *testing.T) {
+	ts := NewTestServer()
+	ts.m.HandleConnect(func(s *Session) {
+		// writePump 尚未啟動，三個佇列都有訊息 (writePump has not started yet, every queue holds a message)
+		s.WritePriority(websocket.TextMessage, []byte("tick"), PriorityTopic)
+		s.Write([]byte("direct"))
+		s.WritePriority(websocket.TextMessage, []byte("control"), PriorityControl)
+	})
+	server := httptest.NewServer(ts)
+	defer server.Close()
+
+	conn, err := NewDialer(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	for _, expected := range []string{"control", "direct", "tick"} {
+		_, ret, err := conn.ReadMessage()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(ret) != expected {
+			t.Errorf("messages should be written by priority, expected %s got %s", expected, string(ret))
+		}
+	}
+}
+
+func TestBatching(t *testing.T) {
+	ts := &TestServer{m: New(DialBatching(Batching{MaxMessages: 2, Format: BatchJSONArray}))}
+	ts.m.HandleConnect(func(s *Session) {
+		for _, msg := range []string{"1", "2", "3"} {
+			s.Write([]byte(msg))
+		}
+		s.WriteBinary([]byte("4"))
+	})
+	server := httptest.NewServer(ts)
+	defer server.Close()
+
+	conn, err := NewDialer(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	for _, expected := range []string{"[1,2]", "3", "4"} {
+		_, ret, err := conn.ReadMessage()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(ret) != expected {
+			t.Errorf("queued messages should be batched, expected %s got %s", expected, string(ret))
+		}
+	}
+}
+
+func TestShardedHub(t *testing.T) {
+	ts := &TestServer{m: New(DialHubShards(4))}
+	ts.m.HandleConnect(func(s *Session) {
+		s.Set("room", "lobby")
+	})
+	server := httptest.NewServer(ts)
+	defer server.Close()
+
+	num := 16
+	conns := make([]*websocket.Conn, 0, num)
+	for i := 0; i < num; i++ {
+		conn, err := NewDialer(server.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		conns = append(conns, conn)
+	}
+
+	for ts.m.Len() < num {
+		time.Sleep(time.Millisecond)
+	}
+
+	used := 0
+	for _, shard := range ts.m.hub.shards {
+		if shard.len() > 0 {
+			used++
+		}
+	}
+	if used < 2 {
+		t.Errorf("sessions should be spread over the shards, %d shards used", used)
+	}
+
+	ts.m.Broadcast([]byte("hello"))
+	for _, conn := range conns {
+		if _, ret, err := conn.ReadMessage(); err != nil || string(ret) != "hello" {
+			t.Errorf("broadcast should reach every shard, got %s %v", string(ret), err)
+		}
+	}
+
+	result, err := ts.m.CloseSessions("room", "lobby", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result["local"] != num {
+		t.Errorf("sessions of every shard should be closed, got %v", result)
+	}
+}
+
+func TestTopicShards(t *testing.T) {
+	joins := make(chan string, 10)
+	ps := pubSubNew(pubSubOptions{
+		bufferSize: 10,
+		shards:     4,
+		presence: func(s *Session, topic string, joined bool) {
+			if joined {
+				joins <- topic
+			}
+		},
+	})
+
+	owner := &Session{}
+	ch := ps.Sub(owner, "quotes.*", "a", "b", "c", "d")
+
+	msg := &envelope{t: websocket.TextMessage, msg: []byte("1")}
+	result, _ := ps.PubContext(context.Background(), msg, false, "a", "b", "quotes.x", "e")
+	if result.Delivered != 3 || len(ch) != 3 {
+		t.Errorf("publish across shards should sum the deliveries, got %d delivered, %d queued", result.Delivered, len(ch))
+	}
+
+	if topics := ps.Topics(); strings.Join(topics, ",") != "a,b,c,d,quotes.*" {
+		t.Errorf("replicated pattern should be listed once, got %v", topics)
+	}
+	if members := ps.Members("quotes.*"); len(members) != 1 || members[0] != owner {
+		t.Errorf("pattern member should be the owner, got %v", members)
+	}
+	if len(joins) != 5 {
+		t.Errorf("presence should fire once per topic, got %d", len(joins))
+	}
+
+	ps.Unsub(ch, "a", "b", "c", "d")
+	if topics := ps.ChannelTopics(ch); strings.Join(topics, ",") != "quotes.*" {
+		t.Errorf("channel should keep the pattern, got %v", topics)
+	}
+
+	ps.Unsub(ch)
+	for range ch {
+	}
+	if topics := ps.Topics(); len(topics) != 0 {
+		t.Errorf("every topic should be gone, got %v", topics)
+	}
+
+	ps.Shutdown()
+	<-ps.done
+}
+
+func TestKeyIndex(t *testing.T) {
+	ts := NewTestServer()
+	ts.m.IndexKey("userID")
+
+	connected := make(chan *Session)
+	users := make(chan int, 3)
+	users <- 1
+	users <- 1
+	users <- 2
+	ts.m.HandleConnect(func(s *Session) {
+		s.Set("userID", <-users)
+		s.Set("rooms", []string{"lobby"})
+		connected <- s
+	})
+	server := httptest.NewServer(ts)
+	defer server.Close()
+
+	conns := make([]*websocket.Conn, 3)
+	sessions := make([]*Session, 3)
+	for i := range conns {
+		conn, err := NewDialer(server.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		conns[i] = conn
+		sessions[i] = <-connected
+	}
+
+	for len(ts.m.SessionsByKey("userID", 1)) != 2 || len(ts.m.SessionsByKey("userID", 2)) != 1 {
+		time.Sleep(time.Millisecond)
+	}
+
+	if err := ts.m.WriteToKey("userID", 2, []byte("hi")); err != nil {
+		t.Fatal(err)
+	}
+	if _, msg, err := conns[2].ReadMessage(); err != nil || string(msg) != "hi" {
+		t.Errorf("indexed session should receive the message, got %q %v", msg, err)
+	}
+
+	if got := len(ts.m.SessionsByKey("rooms", []string{"lobby"})); got != 3 {
+		t.Errorf("unindexed key should be matched by scanning, got %d", got)
+	}
+
+	sessions[1].Set("userID", 2)
+	if got := len(ts.m.SessionsByKey("userID", 1)); got != 1 {
+		t.Errorf("Set should move the session to its new value, got %d", got)
+	}
+
+	result, err := ts.m.CloseSessions("userID", 2, sessions[2].GetHashID())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result["local"] != 1 {
+		t.Errorf("one indexed session should be closed, got %v", result)
+	}
+	if _, _, err := conns[1].ReadMessage(); err == nil {
+		t.Error("closed session should be disconnected")
+	}
+
+	for len(ts.m.SessionsByKey("userID", 2)) != 1 {
+		time.Sleep(time.Millisecond)
+	}
+
+	// 型別可比較但值無法雜湊時改為逐一比對 (comparable type holding an unhashable value falls back to scanning)
+	type tagged struct{ X interface{} }
+	idx := newKeyIndex()
+	idx.declare("tag")
+	s := &Session{keymutex: &sync.RWMutex{}, Keys: map[string]interface{}{"tag": tagged{X: []int{1}}}}
+	idx.add(s)
+	if found := idx.find("tag", tagged{X: []int{1}}); len(found) != 1 || found[0] != s {
+		t.Errorf("unhashable value should be found by scanning, got %v", found)
+	}
+}
+
+func TestWriteToAcrossNodes(t *testing.T) {
+	cluster := NewMemoryCluster()
+	nodeA := New(DialCluster(cluster.Node("a")))
+	nodeB := New(DialCluster(cluster.Node("b")))
+
+	connected := make(chan *Session, 1)
+	nodeA.HandleConnect(func(s *Session) {
+		connected <- s
+	})
+
+	server := httptest.NewServer(&TestServer{m: nodeA})
+	defer server.Close()
+
+	conn, err := NewDialer(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hashID := (<-connected).GetHashID()
+
+	for {
+		if _, ok := nodeA.Session(hashID); ok {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if _, ok := nodeB.Session(hashID); ok {
+		t.Error("session should only be found on its own node")
+	}
+
+	if err := nodeB.WriteTo(hashID, []byte("direct")); err != nil {
+		t.Fatal(err)
+	}
+	if _, msg, err := conn.ReadMessage(); err != nil || string(msg) != "direct" {
+		t.Errorf("session should receive the message of the other node, got %q %v", msg, err)
+	}
+
+	if err := nodeB.WriteTo("missing", []byte("direct")); err != ErrSessionNotFound {
+		t.Errorf("unknown hashID should return ErrSessionNotFound, got %v", err)
+	}
+
+	for _, id := range []string{"c", "d", "e", "f"} {
+		cluster.Node(id).SetHandler(func(*ClusterRequest) *ClusterResponse {
+			return &ClusterResponse{Error: "node unavailable"}
+		})
+	}
+	if err := nodeB.WriteTo(hashID, []byte("delivered")); err != nil {
+		t.Errorf("failing nodes should not hide the node which delivered, got %v", err)
+	}
+	if _, msg, err := conn.ReadMessage(); err != nil || string(msg) != "delivered" {
+		t.Errorf("session should receive the message despite failing nodes, got %q %v", msg, err)
+	}
+	if err := nodeB.WriteTo("missing", []byte("direct")); err == nil || err.Error() != "node unavailable" {
+		t.Errorf("node errors should be returned when no node delivered, got %v", err)
+	}
+
+	conn.Close()
+	for {
+		if _, ok := nodeA.Session(hashID); !ok {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestSessionID(t *testing.T) {
+	next := 0
+	ts := &TestServer{m: New(
+		DialSessionID(func(r *http.Request) string {
+			next++
+			return "node-a-" + strconv.Itoa(next)
+		}),
+		DialClientSessionID(func(r *http.Request, id string) bool {
+			return strings.HasPrefix(id, "client-")
+		}),
+	)}
+
+	connected := make(chan *Session, 1)
+	ts.m.HandleConnect(func(s *Session) {
+		connected <- s
+	})
+	server := httptest.NewServer(ts)
+	defer server.Close()
+
+	conn, err := NewDialer(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if id := (<-connected).GetHashID(); id != "node-a-1" {
+		t.Errorf("generated hashID should be node-a-1, got %s", id)
+	}
+
+	client, err := NewDialer(server.URL + "?" + SessionIDParam + "=client-7")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	if id := (<-connected).GetHashID(); id != "client-7" {
+		t.Errorf("valid client hashID should be kept, got %s", id)
+	}
+
+	if _, err := NewDialer(server.URL + "?" + SessionIDParam + "=forged"); err == nil {
+		t.Error("invalid client hashID should be rejected")
+	}
+
+	for {
+		if _, ok := ts.m.Session("client-7"); ok {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if _, err := NewDialer(server.URL + "?" + SessionIDParam + "=client-7"); err == nil {
+		t.Error("hashID already in use should be rejected")
+	}
+
+	// 由header產生的hashID也可能重複 (IDs derived from a header may repeat as well)
+	fixed := &TestServer{m: New(DialSessionID(func(r *http.Request) string {
+		return "fixed"
+	}))}
+	fixedServer := httptest.NewServer(fixed)
+	defer fixedServer.Close()
+
+	first, err := NewDialer(fixedServer.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer first.Close()
+	if _, err := NewDialer(fixedServer.URL); err == nil {
+		t.Error("generated hashID already in use should be rejected")
+	}
+	for fixed.m.Len() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	if fixed.m.Len() != 1 {
+		t.Errorf("only one session should use the hashID, got %d", fixed.m.Len())
+	}
+}
+
+func TestStampPreparesOnlyForSubscribers(t *testing.T) {
+	for _, prepare := range []bool{true, false} {
+		ps := pubSubNew(pubSubOptions{bufferSize: 1, prepare: prepare})
+		msg := &envelope{t: websocket.TextMessage, msg: []byte("tick")}
+
+		ps.read(func(reg *register) {
+			if reg.stamp("ticks", msg, false).prepared != nil {
+				t.Error("topic without subscribers should not be prepared")
+			}
+			if stamped := reg.stamp("ticks", msg, true); (stamped.prepared != nil) != prepare {
+				t.Errorf("subscribed topic should be prepared only when preparing is on (%v)", prepare)
+			}
+		})
+
+		ps.Shutdown()
+	}
+}
+
 func BenchmarkSessionWrite(b *testing.B) {
 	echo := NewTestServerHandler(func(session *Session, msg []byte) {
 		session.Write(msg)
@@ -723,3 +2212,172 @@ func BenchmarkBroadcast(b *testing.B) {
 		conns[i].Close()
 	}
 }
+
+func BenchmarkBroadcastCompressed(b *testing.B) {
+	broadcast := &TestServer{m: New(DialEnableCompress(true))}
+	server := httptest.NewServer(broadcast)
+	defer server.Close()
+
+	dialer := &websocket.Dialer{EnableCompression: true}
+	msg := bytes.Repeat([]byte("compressible "), 100)
+
+	conns := make([]*websocket.Conn, 0)
+
+	num := 100
+
+	for i := 0; i < num; i++ {
+		conn, _, _ := dialer.Dial(strings.Replace(server.URL, "http", "ws", 1), nil)
+		conns = append(conns, conn)
+	}
+
+	for broadcast.m.Len() < num {
+		time.Sleep(time.Millisecond)
+	}
+
+	b.ResetTimer()
+	for n := 0; n < b.N; n++ {
+		broadcast.m.Broadcast(msg)
+
+		for i := 0; i < num; i++ {
+			conns[i].ReadMessage()
+		}
+	}
+	b.StopTimer()
+
+	for i := 0; i < num; i++ {
+		conns[i].Close()
+	}
+}
+
+func BenchmarkPublish(b *testing.B) {
+	ts := NewTestServer()
+	ts.m.HandleConnect(func(s *Session) {
+		s.AddSub("ticks")
+	})
+	server := httptest.NewServer(ts)
+	defer server.Close()
+
+	conns := make([]*websocket.Conn, 0)
+
+	num := 100
+
+	for i := 0; i < num; i++ {
+		conn, _ := NewDialer(server.URL)
+		conns = append(conns, conn)
+	}
+
+	for len(ts.m.TopicSubscribers("ticks")) < num {
+		time.Sleep(time.Millisecond)
+	}
+
+	b.ResetTimer()
+	for n := 0; n < b.N; n++ {
+		ts.m.PubTextMsg([]byte("tick"), false, "ticks")
+
+		for i := 0; i < num; i++ {
+			conns[i].ReadMessage()
+		}
+	}
+	b.StopTimer()
+
+	for i := 0; i < num; i++ {
+		conns[i].Close()
+	}
+}
+
+// BenchmarkConnectDuringBroadcast 持續廣播時建立連線的延遲 (latency of new connections while broadcasts keep running)
+func BenchmarkConnectDuringBroadcast(b *testing.B) {
+	for _, shards := range []int{1, 8} {
+		b.Run("shards="+strconv.Itoa(shards), func(b *testing.B) {
+			ts := &TestServer{m: New(DialHubShards(shards))}
+			server := httptest.NewServer(ts)
+			defer server.Close()
+
+			num := 200
+			for i := 0; i < num; i++ {
+				conn, _ := NewDialer(server.URL)
+				defer conn.Close()
+				go func() {
+					for {
+						if _, _, err := conn.ReadMessage(); err != nil {
+							return
+						}
+					}
+				}()
+			}
+
+			stop := make(chan struct{})
+			defer close(stop)
+			go func() {
+				for {
+					select {
+					case <-stop:
+						return
+					default:
+						ts.m.Broadcast([]byte("tick"))
+					}
+				}
+			}()
+
+			b.ResetTimer()
+			for n := 0; n < b.N; n++ {
+				conn, err := NewDialer(server.URL)
+				if err != nil {
+					b.Fatal(err)
+				}
+				conn.Close()
+			}
+			b.StopTimer()
+		})
+	}
+}
+
+// benchmarkPublishTopics 在不同分片數下發布到topics (publish to topics round robin with 1 and 8 pub/sub workers)
+func benchmarkPublishTopics(b *testing.B, topics []string, subscribers int) {
+	for _, shards := range []int{1, 8} {
+		b.Run("shards="+strconv.Itoa(shards), func(b *testing.B) {
+			ps := pubSubNew(pubSubOptions{bufferSize: 256, shards: shards})
+
+			var wg sync.WaitGroup
+			for i := 0; i < subscribers; i++ {
+				ch := ps.Sub(nil, topics...)
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					for range ch {
+					}
+				}()
+			}
+
+			msg := &envelope{t: websocket.TextMessage, msg: []byte("tick")}
+
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				i := 0
+				for pb.Next() {
+					ps.PubContext(context.Background(), msg, false, topics[i%len(topics)])
+					i++
+				}
+			})
+			b.StopTimer()
+
+			ps.Shutdown()
+			wg.Wait()
+		})
+	}
+}
+
+// BenchmarkPublishManyTopics 發布到許多主題 (publishes spread over many topics)
+func BenchmarkPublishManyTopics(b *testing.B) {
+	topics := make([]string, 256)
+	for i := range topics {
+		topics[i] = "topic." + strconv.Itoa(i)
+	}
+
+	benchmarkPublishTopics(b, topics, 10)
+}
+
+// BenchmarkPublishHotTopic 所有發布都集中在同一個主題 (every publish goes to one hot topic)
+func BenchmarkPublishHotTopic(b *testing.B) {
+	benchmarkPublishTopics(b, []string{"hot"}, 100)
+}
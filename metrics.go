@@ -0,0 +1,256 @@
+package melody
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// Metrics 監控指標 (receives the measurements of a melody instance, set it with DialMetrics)
+// Every method may be called concurrently and must not block.
+type Metrics interface {
+	// SessionOpened Session已註冊 (a session was registered)
+	SessionOpened()
+	// SessionClosed Session已移除 (a session was unregistered)
+	SessionClosed()
+	// MessageReceived 收到訊息 (a text or binary message of size bytes was read)
+	MessageReceived(messageType int, size int)
+	// MessageSent 送出訊息 (a text or binary message of size bytes was written)
+	MessageSent(messageType int, size int)
+	// MessageDropped Session緩衝區已滿而遺失訊息 (a message was dropped because the session buffer was full)
+	MessageDropped(messageType int)
+	// PingRTT ping到pong的時間 (round trip time between a ping and its pong)
+	PingRTT(rtt time.Duration)
+	// TopicPublished 主題訊息的發布結果 (a message was published to the local subscribers of topic)
+	TopicPublished(topic string, delivered int, dropped int)
+	// TopicSubscribers 主題的訂閱者數量 (the number of subscribers of topic changed)
+	TopicSubscribers(topic string, count int)
+}
+
+// DialMetrics set the Metrics receiving the measurements of the melody instance, e.g. NewPrometheusMetrics.
+func DialMetrics(metrics Metrics) DialOption {
+	return DialOption{func(do *dialOptions) {
+		do.metrics = metrics
+	}}
+}
+
+// noopMetrics 預設不記錄任何指標 (default Metrics discarding everything)
+type noopMetrics struct{}
+
+func (noopMetrics) SessionOpened()                  {}
+func (noopMetrics) SessionClosed()                  {}
+func (noopMetrics) MessageReceived(int, int)        {}
+func (noopMetrics) MessageSent(int, int)            {}
+func (noopMetrics) MessageDropped(int)              {}
+func (noopMetrics) PingRTT(time.Duration)           {}
+func (noopMetrics) TopicPublished(string, int, int) {}
+func (noopMetrics) TopicSubscribers(string, int)    {}
+
+// rttBuckets ping RTT直方圖的上限(秒) (upper bounds in seconds of the ping RTT histogram)
+var rttBuckets = []float64{.001, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5}
+
+// messageTypeLabel 訊息類型標籤 (label value of a message type)
+func messageTypeLabel(messageType int) string {
+	if messageType == websocket.BinaryMessage {
+		return "binary"
+	}
+
+	return "text"
+}
+
+// labelEscaper 標籤值跳脫 (escapes label values of the text format)
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// PrometheusMetrics is the built-in Metrics, it serves the measurements in the Prometheus text format:
+//
+//	http.Handle("/metrics", metrics)
+type PrometheusMetrics struct {
+	namespace string
+	mutex     *sync.Mutex
+
+	opened, closed uint64
+	received, sent map[string]uint64 // Key: 訊息類型 (message type label)
+	receivedBytes  map[string]uint64
+	sentBytes      map[string]uint64
+	dropped        map[string]uint64
+	rttBuckets     []uint64
+	rttSum         float64
+	rttCount       uint64
+	delivered      map[string]uint64 // Key: topic
+	topicDropped   map[string]uint64 // Key: topic
+	subscribers    map[string]int    // Key: topic
+}
+
+// NewPrometheusMetrics creates a PrometheusMetrics whose metric names start with namespace, e.g. "melody".
+func NewPrometheusMetrics(namespace string) *PrometheusMetrics {
+	return &PrometheusMetrics{
+		namespace:     namespace,
+		mutex:         &sync.Mutex{},
+		received:      make(map[string]uint64),
+		sent:          make(map[string]uint64),
+		receivedBytes: make(map[string]uint64),
+		sentBytes:     make(map[string]uint64),
+		dropped:       make(map[string]uint64),
+		rttBuckets:    make([]uint64, len(rttBuckets)),
+		delivered:     make(map[string]uint64),
+		topicDropped:  make(map[string]uint64),
+		subscribers:   make(map[string]int),
+	}
+}
+
+// SessionOpened implements Metrics.
+func (p *PrometheusMetrics) SessionOpened() {
+	p.mutex.Lock()
+	p.opened++
+	p.mutex.Unlock()
+}
+
+// SessionClosed implements Metrics.
+func (p *PrometheusMetrics) SessionClosed() {
+	p.mutex.Lock()
+	p.closed++
+	p.mutex.Unlock()
+}
+
+// MessageReceived implements Metrics.
+func (p *PrometheusMetrics) MessageReceived(messageType int, size int) {
+	label := messageTypeLabel(messageType)
+
+	p.mutex.Lock()
+	p.received[label]++
+	p.receivedBytes[label] += uint64(size)
+	p.mutex.Unlock()
+}
+
+// MessageSent implements Metrics.
+func (p *PrometheusMetrics) MessageSent(messageType int, size int) {
+	label := messageTypeLabel(messageType)
+
+	p.mutex.Lock()
+	p.sent[label]++
+	p.sentBytes[label] += uint64(size)
+	p.mutex.Unlock()
+}
+
+// MessageDropped implements Metrics.
+func (p *PrometheusMetrics) MessageDropped(messageType int) {
+	label := messageTypeLabel(messageType)
+
+	p.mutex.Lock()
+	p.dropped[label]++
+	p.mutex.Unlock()
+}
+
+// PingRTT implements Metrics.
+func (p *PrometheusMetrics) PingRTT(rtt time.Duration) {
+	seconds := rtt.Seconds()
+
+	p.mutex.Lock()
+	for i, bound := range rttBuckets {
+		if seconds <= bound {
+			p.rttBuckets[i]++
+		}
+	}
+	p.rttSum += seconds
+	p.rttCount++
+	p.mutex.Unlock()
+}
+
+// TopicPublished implements Metrics.
+func (p *PrometheusMetrics) TopicPublished(topic string, delivered int, dropped int) {
+	p.mutex.Lock()
+	p.delivered[topic] += uint64(delivered)
+	p.topicDropped[topic] += uint64(dropped)
+	p.mutex.Unlock()
+}
+
+// TopicSubscribers implements Metrics.
+func (p *PrometheusMetrics) TopicSubscribers(topic string, count int) {
+	p.mutex.Lock()
+	if count == 0 {
+		delete(p.subscribers, topic)
+	} else {
+		p.subscribers[topic] = count
+	}
+	p.mutex.Unlock()
+}
+
+// ServeHTTP writes the metrics in the Prometheus text format.
+func (p *PrometheusMetrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	p.WriteTo(w)
+}
+
+// WriteTo writes the metrics in the Prometheus text format to w.
+func (p *PrometheusMetrics) WriteTo(w io.Writer) (int64, error) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	var b strings.Builder
+
+	p.header(&b, "sessions_opened_total", "counter", "Sessions opened.")
+	fmt.Fprintf(&b, "%s %d\n", p.name("sessions_opened_total"), p.opened)
+	p.header(&b, "sessions_closed_total", "counter", "Sessions closed.")
+	fmt.Fprintf(&b, "%s %d\n", p.name("sessions_closed_total"), p.closed)
+	p.header(&b, "sessions_active", "gauge", "Sessions currently open.")
+	fmt.Fprintf(&b, "%s %d\n", p.name("sessions_active"), p.opened-p.closed)
+
+	p.labeled(&b, "messages_received_total", "counter", "Messages received by type.", "type", p.received)
+	p.labeled(&b, "messages_received_bytes_total", "counter", "Bytes received by message type.", "type", p.receivedBytes)
+	p.labeled(&b, "messages_sent_total", "counter", "Messages sent by type.", "type", p.sent)
+	p.labeled(&b, "messages_sent_bytes_total", "counter", "Bytes sent by message type.", "type", p.sentBytes)
+	p.labeled(&b, "messages_dropped_total", "counter", "Messages dropped because the session buffer was full.", "type", p.dropped)
+
+	p.header(&b, "ping_rtt_seconds", "histogram", "Round trip time between pings and pongs.")
+	for i, bound := range rttBuckets {
+		fmt.Fprintf(&b, "%s_bucket{le=\"%g\"} %d\n", p.name("ping_rtt_seconds"), bound, p.rttBuckets[i])
+	}
+	fmt.Fprintf(&b, "%s_bucket{le=\"+Inf\"} %d\n", p.name("ping_rtt_seconds"), p.rttCount)
+	fmt.Fprintf(&b, "%s_sum %g\n", p.name("ping_rtt_seconds"), p.rttSum)
+	fmt.Fprintf(&b, "%s_count %d\n", p.name("ping_rtt_seconds"), p.rttCount)
+
+	p.labeled(&b, "topic_messages_delivered_total", "counter", "Topic messages delivered to local subscribers.", "topic", p.delivered)
+	p.labeled(&b, "topic_messages_dropped_total", "counter", "Topic messages dropped because a subscriber buffer was full.", "topic", p.topicDropped)
+
+	subscribers := make(map[string]uint64, len(p.subscribers))
+	for topic, count := range p.subscribers {
+		subscribers[topic] = uint64(count)
+	}
+	p.labeled(&b, "topic_subscribers", "gauge", "Local subscribers by topic.", "topic", subscribers)
+
+	n, err := io.WriteString(w, b.String())
+	return int64(n), err
+}
+
+func (p *PrometheusMetrics) name(metric string) string {
+	if p.namespace == "" {
+		return metric
+	}
+
+	return p.namespace + "_" + metric
+}
+
+func (p *PrometheusMetrics) header(b *strings.Builder, metric, kind, help string) {
+	fmt.Fprintf(b, "# HELP %s %s\n# TYPE %s %s\n", p.name(metric), help, p.name(metric), kind)
+}
+
+// labeled 依標籤排序輸出 (write a metric with one sample per label value, sorted by label)
+func (p *PrometheusMetrics) labeled(b *strings.Builder, metric, kind, help, label string, values map[string]uint64) {
+	p.header(b, metric, kind, help)
+
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		fmt.Fprintf(b, "%s{%s=\"%s\"} %d\n", p.name(metric), label, labelEscaper.Replace(key), values[key])
+	}
+}
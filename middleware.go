@@ -0,0 +1,107 @@
+package melody
+
+import "math"
+
+// EventKind 事件種類 (kind of event passed through the middleware chain)
+type EventKind int
+
+// Event kinds passed through the middleware chain.
+const (
+	EventConnect EventKind = iota
+	EventDisconnect
+	EventMessage
+	EventMessageBinary
+)
+
+func (k EventKind) String() string {
+	switch k {
+	case EventConnect:
+		return "connect"
+	case EventDisconnect:
+		return "disconnect"
+	case EventMessage:
+		return "message"
+	case EventMessageBinary:
+		return "message_binary"
+	}
+
+	return "unknown"
+}
+
+// abortIndex 中斷後的位置 (chain position after Abort, past every handler)
+const abortIndex = math.MaxInt32 / 2
+
+// MiddlewareFunc 中介層 (middleware wrapping the connect, disconnect and message handlers)
+type MiddlewareFunc func(*Event)
+
+// Event 經過中介層的事件 (an event travelling through the middleware chain)
+type Event struct {
+	Kind    EventKind
+	Session *Session
+	Message []byte // 訊息內容，連線事件為nil (message data, nil for connect and disconnect)
+
+	handlers []MiddlewareFunc
+	index    int
+}
+
+// Next runs the rest of the chain, ending with the handler of the event, and returns once it is done.
+// Middleware that do not call Next still let the chain continue after them, like in gin.
+func (e *Event) Next() {
+	e.index++
+	for e.index < len(e.handlers) {
+		e.handlers[e.index](e)
+		e.index++
+	}
+}
+
+// Abort stops the chain, neither the remaining middleware nor the handler of the event run.
+func (e *Event) Abort() {
+	e.index = abortIndex
+}
+
+// IsAborted reports whether Abort was called.
+func (e *Event) IsAborted() bool {
+	return e.index >= abortIndex
+}
+
+// Use appends middleware wrapping the connect, disconnect, text and binary message handlers.
+// They run in the order they were added, each may inspect or replace Event.Message, call
+// Next to run the rest of the chain, or Abort it. Use must be called before serving requests.
+func (m *Melody) Use(middleware ...MiddlewareFunc) {
+	m.middleware = append(m.middleware, middleware...)
+}
+
+// dispatch 經過中介層執行handler (run handler behind the middleware chain)
+func (m *Melody) dispatch(kind EventKind, s *Session, msg []byte, handler func(*Session, []byte)) {
+	if len(m.middleware) == 0 {
+		handler(s, msg)
+		return
+	}
+
+	handlers := make([]MiddlewareFunc, 0, len(m.middleware)+1)
+	handlers = append(handlers, m.middleware...)
+	handlers = append(handlers, func(e *Event) {
+		handler(e.Session, e.Message)
+	})
+
+	e := &Event{Kind: kind, Session: s, Message: msg, handlers: handlers, index: -1}
+	e.Next()
+}
+
+func (m *Melody) handleConnect(s *Session, _ []byte) {
+	m.connectHandler(s)
+}
+
+func (m *Melody) handleDisconnect(s *Session, _ []byte) {
+	m.disconnectHandler(s)
+}
+
+func (m *Melody) handleMessage(s *Session, msg []byte) {
+	if !s.handleRPC(msg) {
+		m.messageHandler(s, msg)
+	}
+}
+
+func (m *Melody) handleMessageBinary(s *Session, msg []byte) {
+	m.messageHandlerBinary(s, msg)
+}
@@ -0,0 +1,159 @@
+package melody
+
+import (
+	"reflect"
+	"sync"
+)
+
+type handlePresenceFunc func(*Session, string)
+
+// presenceEvent Session加入或離開主題 (a session joined or left a topic)
+type presenceEvent struct {
+	session *Session
+	topic   string
+	joined  bool
+}
+
+// presence 在獨立的goroutine中依序觸發加入/離開事件，避免阻塞訂閱服務
+// (fires join/leave handlers in order on its own goroutine, so handlers may call back into the pub/sub service)
+type presence struct {
+	mutex    *sync.Mutex
+	queue    []presenceEvent
+	notify   chan struct{}
+	done     chan struct{} // 關機時關閉 (closed on shutdown)
+	stopOnce *sync.Once
+
+	handlerMutex  *sync.RWMutex
+	joinHandlers  map[string][]handlePresenceFunc
+	leaveHandlers map[string][]handlePresenceFunc
+}
+
+func newPresence() *presence {
+	return &presence{
+		mutex:         &sync.Mutex{},
+		notify:        make(chan struct{}, 1),
+		done:          make(chan struct{}),
+		stopOnce:      &sync.Once{},
+		handlerMutex:  &sync.RWMutex{},
+		joinHandlers:  make(map[string][]handlePresenceFunc),
+		leaveHandlers: make(map[string][]handlePresenceFunc),
+	}
+}
+
+// push 加入事件，不會阻塞 (queue an event without blocking)
+func (p *presence) push(session *Session, topic string, joined bool) {
+	p.mutex.Lock()
+	p.queue = append(p.queue, presenceEvent{session: session, topic: topic, joined: joined})
+	p.mutex.Unlock()
+
+	select {
+	case p.notify <- struct{}{}:
+	default:
+	}
+}
+
+func (p *presence) run() {
+	for {
+		select {
+		case <-p.notify:
+			p.flush()
+		case <-p.done:
+			p.flush()
+			return
+		}
+	}
+}
+
+// flush 觸發所有排隊中的事件 (fire every queued event)
+func (p *presence) flush() {
+	p.mutex.Lock()
+	events := p.queue
+	p.queue = nil
+	p.mutex.Unlock()
+
+	for _, event := range events {
+		p.fire(event)
+	}
+}
+
+// stop 觸發剩餘事件後結束run (fire the remaining events and end run)
+func (p *presence) stop() {
+	p.stopOnce.Do(func() {
+		close(p.done)
+	})
+}
+
+func (p *presence) fire(event presenceEvent) {
+	handlers := p.leaveHandlers
+	if event.joined {
+		handlers = p.joinHandlers
+	}
+
+	p.handlerMutex.RLock()
+	var matched []handlePresenceFunc
+	for topic, fns := range handlers {
+		if topic == event.topic || (isTopicPattern(topic) && matchTopic(topic, event.topic)) {
+			matched = append(matched, fns...)
+		}
+	}
+	p.handlerMutex.RUnlock()
+
+	for _, fn := range matched {
+		if err := safe(func() {
+			fn(event.session, event.topic)
+		}); err != nil {
+			event.session.panicked(err)
+		}
+	}
+}
+
+func (p *presence) handle(handlers map[string][]handlePresenceFunc, topic string, fn handlePresenceFunc) {
+	p.handlerMutex.Lock()
+	defer p.handlerMutex.Unlock()
+	handlers[topic] = append(handlers[topic], fn)
+}
+
+// HandleJoin fires fn with the session and the topic when a session subscribes to topic.
+// topic may be a wildcard pattern, fn then fires for every matching topic. Handlers run in
+// order on their own goroutine, so they may subscribe or publish.
+func (m *Melody) HandleJoin(topic string, fn func(*Session, string)) {
+	m.presence.handle(m.presence.joinHandlers, topic, fn)
+}
+
+// HandleLeave fires fn with the session and the topic when a session unsubscribes from topic,
+// including when it disconnects. topic may be a wildcard pattern like in HandleJoin.
+func (m *Melody) HandleLeave(topic string, fn func(*Session, string)) {
+	m.presence.handle(m.presence.leaveHandlers, topic, fn)
+}
+
+// Presence returns the sessions of this node subscribed to topic itself, not through a wildcard pattern.
+func (m *Melody) Presence(topic string) []*Session {
+	return m.pubsub.Members(topic)
+}
+
+// PresenceKeys returns the distinct values stored under key by the sessions present in topic,
+// e.g. the user ids of a chat room with several sessions per user.
+func (m *Melody) PresenceKeys(topic string, key string) []interface{} {
+	var values []interface{}
+
+	for _, s := range m.Presence(topic) {
+		value, exists := s.Get(key)
+		if !exists {
+			continue
+		}
+
+		duplicate := false
+		for _, v := range values {
+			if reflect.DeepEqual(v, value) {
+				duplicate = true
+				break
+			}
+		}
+
+		if !duplicate {
+			values = append(values, value)
+		}
+	}
+
+	return values
+}
@@ -0,0 +1,30 @@
+package melody
+
+import "errors"
+
+// Priority 寫入佇列的優先順序 (write priority class of a message)
+//
+// writePump always writes every queued control message before direct messages, and every direct
+// message before topic messages, so a Session.Write is not stuck behind a burst of topic messages.
+type Priority int
+
+const (
+	// PriorityTopic 主題訊息，緩衝區大小為DialChannelBufferSize (topic messages, buffered by DialChannelBufferSize)
+	PriorityTopic Priority = iota - 1
+	// PriorityDirect 直接訊息與廣播，緩衝區大小為Config.MessageBufferSize (direct writes and broadcasts, buffered by Config.MessageBufferSize)
+	PriorityDirect
+	// PriorityControl 控制訊息與RPC，緩衝區大小為Config.ControlBufferSize (control messages and RPC frames, buffered by Config.ControlBufferSize)
+	PriorityControl
+)
+
+// WritePriority writes a message of messageType (TextMessage or BinaryMessage) to the session
+// in the given priority class.
+func (s *Session) WritePriority(messageType int, msg []byte, priority Priority) error {
+	if s.closed() {
+		return errors.New("session is closed")
+	}
+
+	s.writeMessage(&envelope{t: messageType, msg: msg, priority: priority})
+
+	return nil
+}
@@ -1,5 +1,15 @@
 package melody
 
+import (
+	"context"
+	"hash/fnv"
+	"sort"
+	"sync"
+	"time"
+
+	uuid "github.com/satori/go.uuid"
+)
+
 type operation int
 
 const (
@@ -17,116 +27,622 @@ const (
 	CloseTopic
 	// ShutDown 此訂閱服務關機 (shutdown this pub/sub service)
 	ShutDown
+	// Inspect 讀取訂閱資料 (read the register on the pub/sub goroutine)
+	Inspect
+	// SetHistory 設定主題歷史 (configure the history of the topic)
+	SetHistory
+	// SetSlowConsumer 設定主題的慢速消費者策略 (configure the slow consumer policy of the topic)
+	SetSlowConsumer
 )
 
 // pubSubPattern 集合topic,capacity是容量 (topic set, buffer channel size)
 type pubSub struct {
-	commandChan chan cmd // 接收指令的channel
-	bufferSize  int
+	workers      []*pubSubWorker // 依主題分片的goroutine (goroutines each owning a partition of the topics)
+	done         chan struct{}   // 關機後關閉 (closed once every worker exited)
+	chanMutex    *sync.Mutex
+	channels     map[chan *envelope]*subChannel // 由Sub建立、尚未關閉的channel (channels created by Sub and not closed yet)
+	bufferSize   int
+	history      historyConfig // 預設主題歷史設定 (default topic history settings)
+	framer       func(*Message) []byte
+	presence     func(*Session, string, bool)
+	nodeID       string      // 本節點識別碼，用來忽略自己發出的代理訊息 (ignore broker messages published by this node)
+	broker       Broker      // 跨節點代理 (cross-node broker)
+	errorHandler func(error) // 代理錯誤處理 (broker error handler)
+	metrics      Metrics
+	slowConsumer *SlowConsumer
+	slowHandler  func(*Session, string, SlowConsumerPolicy)
+	prepare      bool
+}
+
+// subChannel 訂閱channel的擁有者與各worker中的訂閱數，歸零時關閉channel
+// (owner of a subscribe channel and its subscriptions across the workers, the channel is closed when they drop to zero)
+type subChannel struct {
+	owner *Session
+	refs  int
+}
+
+// pubSubWorker 處理部分主題的goroutine (goroutine owning the topics hashed to it)
+type pubSubWorker struct {
+	commandChan chan cmd      // 接收指令的channel
+	done        chan struct{} // 結束後關閉 (closed once the worker exited)
+}
+
+// send 送出指令，結束後直接放棄 (send a command, gives up once the worker exited)
+func (w *pubSubWorker) send(c cmd) bool {
+	select {
+	case w.commandChan <- c:
+		return true
+	case <-w.done:
+		return false
+	}
 }
 
 type cmd struct {
-	opCode operation      // 指令 (command)
-	topics []string       // 訂閱的主題 (subscribe topics)
-	ch     chan *envelope // 使用的channel (channel used by subscriber)
-	msg    *envelope      // 訊息內文 (msg data)
+	opCode   operation                      // 指令 (command)
+	topics   []string                       // 訂閱的主題 (subscribe topics)
+	ch       chan *envelope                 // 使用的channel (channel used by subscriber)
+	msg      *envelope                      // 訊息內文 (msg data)
+	ctx      context.Context                // 發布的期限 (publish deadline, nil means wait forever)
+	result   chan *PublishResult            // 發布結果 (publish result, nil when nobody waits for it)
+	owner    *Session                       // 訂閱channel的Session (session owning ch)
+	inspect  func(*register)                // 讀取訂閱資料 (read the register, used by Inspect)
+	replay   *Replay                        // 訂閱時重播歷史 (history replayed on subscribe)
+	replayed chan map[string][]historyEntry // 萬用字元訂閱的歷史，由AddSubReplay合併 (history matching wildcard subscriptions, merged by AddSubReplay)
+	history  historyConfig                  // 主題歷史設定 (history settings, used by SetHistory)
+	policy   SlowConsumer                   // 慢速消費者策略 (slow consumer policy, used by SetSlowConsumer)
+}
+
+// PublishResult 發布結果，只計算本節點的訂閱者 (publish result, only subscribers of the local node are counted)
+type PublishResult struct {
+	Delivered int // 收到訊息的訂閱者 (subscribers which received the message)
+	Dropped   int // 緩衝區已滿而遺失訊息的訂閱者 (subscribers whose buffer was full)
+}
+
+// pubSubOptions 訂閱服務設定 (pub/sub settings)
+type pubSubOptions struct {
+	bufferSize          int                                        // 訂閱channel大小 (subscribe channel buffer size)
+	history             historyConfig                              // 預設主題歷史設定 (default topic history settings)
+	framer              func(*Message) []byte                      // 主題訊息封裝 (frames topic messages sent to clients, nil sends the raw data)
+	broker              Broker                                     // 跨節點代理 (cross-node broker, nil for a single node)
+	errorHandler        func(error)                                // 代理錯誤處理 (broker error handler)
+	presence            func(*Session, string, bool)               // Session加入/離開主題 (session joined or left a topic, must not block)
+	metrics             Metrics                                    // 監控指標 (receives topic measurements, nil discards them)
+	slowConsumer        *SlowConsumer                              // 預設慢速消費者策略 (default slow consumer policy, nil waits in Publish and drops in AsyncPublish)
+	slowConsumerHandler func(*Session, string, SlowConsumerPolicy) // 慢速消費者策略觸發 (a slow consumer policy fired, must not block)
+	shards              int                                        // 主題分片數量 (number of topic partitions, each with its own goroutine, at least 1)
+	prepare             bool                                       // 預先編碼frame (prepare the frame of topic messages once for all subscribers)
 }
 
 // pubSubNew 創建一個訂閱者模式 (create a new pub/sub pattern)
-func pubSubNew(bufferSize int) *pubSub {
-	ps := &pubSub{make(chan cmd), bufferSize}
+func pubSubNew(options pubSubOptions) *pubSub {
+	broker := options.broker
+	if broker == nil {
+		broker = newLocalBroker()
+	}
+
+	errorHandler := options.errorHandler
+	if errorHandler == nil {
+		errorHandler = func(error) {}
+	}
+
+	if options.presence == nil {
+		options.presence = func(*Session, string, bool) {}
+	}
+
+	if options.metrics == nil {
+		options.metrics = noopMetrics{}
+	}
+
+	if options.slowConsumerHandler == nil {
+		options.slowConsumerHandler = func(*Session, string, SlowConsumerPolicy) {}
+	}
+
+	if options.shards < 1 {
+		options.shards = 1
+	}
+
+	ps := &pubSub{
+		workers:      make([]*pubSubWorker, options.shards),
+		done:         make(chan struct{}),
+		chanMutex:    &sync.Mutex{},
+		channels:     make(map[chan *envelope]*subChannel),
+		bufferSize:   options.bufferSize,
+		history:      options.history,
+		framer:       options.framer,
+		presence:     options.presence,
+		nodeID:       uuid.NewV4().String(),
+		broker:       broker,
+		errorHandler: errorHandler,
+		metrics:      options.metrics,
+		slowConsumer: options.slowConsumer,
+		slowHandler:  options.slowConsumerHandler,
+		prepare:      options.prepare,
+	}
+	for i := range ps.workers {
+		ps.workers[i] = &pubSubWorker{commandChan: make(chan cmd), done: make(chan struct{})}
+	}
+
+	broker.SetHandler(ps.deliver)
 	go ps.start()
 	return ps
 }
 
+// workerOf 主題所屬的worker (worker owning topic)
+func (ps *pubSub) workerOf(topic string) *pubSubWorker {
+	if len(ps.workers) == 1 {
+		return ps.workers[0]
+	}
+
+	hash := fnv.New32a()
+	hash.Write([]byte(topic))
+	return ps.workers[hash.Sum32()%uint32(len(ps.workers))]
+}
+
+// route 依worker分組主題，萬用字元訂閱複製到每個worker
+// (group topics by worker, wildcard (un)subscriptions go to every worker since they match topics of every partition)
+func (ps *pubSub) route(op operation, topics []string) map[*pubSubWorker][]string {
+	groups := make(map[*pubSubWorker][]string)
+	for _, topic := range topics {
+		if isTopicPattern(topic) && op != Publish && op != AsyncPublish {
+			for _, w := range ps.workers {
+				groups[w] = append(groups[w], topic)
+			}
+			continue
+		}
+
+		w := ps.workerOf(topic)
+		groups[w] = append(groups[w], topic)
+	}
+
+	return groups
+}
+
+// retain worker新增channel的訂閱，channel已關閉時回傳false (a worker added a subscription of ch, false once ch was closed)
+func (ps *pubSub) retain(ch chan *envelope) bool {
+	ps.chanMutex.Lock()
+	defer ps.chanMutex.Unlock()
+
+	sc, ok := ps.channels[ch]
+	if !ok {
+		return false
+	}
+
+	sc.refs++
+	return true
+}
+
+// release worker移除channel的訂閱，所有worker都移除後關閉channel (a worker removed a subscription of ch, ch is closed after the last one)
+func (ps *pubSub) release(ch chan *envelope) {
+	ps.chanMutex.Lock()
+	defer ps.chanMutex.Unlock()
+
+	sc, ok := ps.channels[ch]
+	if !ok {
+		return
+	}
+
+	sc.refs--
+	if sc.refs == 0 {
+		delete(ps.channels, ch)
+		close(ch)
+	}
+}
+
+// ownerOf 擁有channel的Session (session owning ch, nil for plain channels)
+func (ps *pubSub) ownerOf(ch chan *envelope) *Session {
+	ps.chanMutex.Lock()
+	defer ps.chanMutex.Unlock()
+
+	if sc, ok := ps.channels[ch]; ok {
+		return sc.owner
+	}
+
+	return nil
+}
+
 // Sub 創建一個新的訂閱頻道, 並將channel回傳 (create a channel for subscribe topic, and return it)
-func (ps *pubSub) Sub(topics ...string) chan *envelope {
-	return ps.sub(Subscribe, topics...)
+func (ps *pubSub) Sub(owner *Session, topics ...string) chan *envelope {
+	return ps.sub(Subscribe, owner, topics...)
 }
 
-func (ps *pubSub) sub(op operation, topics ...string) chan *envelope {
+func (ps *pubSub) sub(op operation, owner *Session, topics ...string) chan *envelope {
 	ch := make(chan *envelope, ps.bufferSize)
-	ps.commandChan <- cmd{opCode: op, topics: topics, ch: ch}
+	ps.chanMutex.Lock()
+	ps.channels[ch] = &subChannel{owner: owner}
+	ps.chanMutex.Unlock()
+
+	ps.send(cmd{opCode: op, topics: topics, ch: ch, owner: owner})
 	return ch
 }
 
+// send 將指令交給負責的worker，沒有主題的指令交給每個worker，回傳收到指令的worker數量
+// (hand the command to the workers owning its topics, or to every worker when it has none; returns how many workers took it)
+func (ps *pubSub) send(c cmd) int {
+	if c.ch != nil && c.owner == nil {
+		c.owner = ps.ownerOf(c.ch)
+	}
+
+	sent := 0
+	if c.topics == nil {
+		for _, w := range ps.workers {
+			if w.send(c) {
+				sent++
+			}
+		}
+		return sent
+	}
+
+	for w, topics := range ps.route(c.opCode, c.topics) {
+		part := c
+		part.topics = topics
+		if w.send(part) {
+			sent++
+		}
+	}
+
+	return sent
+}
+
 // AddSub 將要訂閱的Topic加到現有的channel (add topics into the subscribe channel)
 func (ps *pubSub) AddSub(ch chan *envelope, topics ...string) {
-	ps.commandChan <- cmd{opCode: Subscribe, topics: topics, ch: ch}
+	ps.send(cmd{opCode: Subscribe, topics: topics, ch: ch})
+}
+
+// AddSubReplay 訂閱並重播歷史訊息 (add topics into the subscribe channel and replay their history)
+// 萬用字元符合的主題分散在各worker，先收集所有worker的歷史再排序與套用Last
+// (topics matching a wildcard live on every worker, so their history is collected from all of them before ordering and applying Last)
+func (ps *pubSub) AddSubReplay(ch chan *envelope, replay *Replay, topics ...string) {
+	replayed := make(chan map[string][]historyEntry, len(ps.workers))
+	sent := ps.send(cmd{opCode: Subscribe, topics: topics, ch: ch, replay: replay, replayed: replayed})
+
+	patterns := make(map[string][]historyEntry)
+	for i := 0; i < sent; i++ {
+		for pattern, entries := range <-replayed {
+			patterns[pattern] = append(patterns[pattern], entries...)
+		}
+	}
+
+	// 持有chanMutex避免channel在重播時被關閉 (hold chanMutex so ch cannot be closed while the history is queued)
+	ps.chanMutex.Lock()
+	defer ps.chanMutex.Unlock()
+
+	if _, ok := ps.channels[ch]; !ok {
+		return
+	}
+
+	for _, topic := range topics {
+		if entries, ok := patterns[topic]; ok {
+			queueReplay(ch, mergeReplay(entries, replay))
+			delete(patterns, topic)
+		}
+	}
+}
+
+// SetSlowConsumer 設定主題訂閱者緩衝區已滿時的策略 (set the policy applied when a subscriber of topic has a full buffer)
+func (ps *pubSub) SetSlowConsumer(topic string, policy SlowConsumer) {
+	ps.send(cmd{opCode: SetSlowConsumer, topics: []string{topic}, policy: policy})
+}
+
+// SetHistory 設定主題保留的訊息數量與時間 (set how many messages of topic are kept and for how long)
+func (ps *pubSub) SetHistory(topic string, size int, ttl time.Duration) {
+	ps.send(cmd{opCode: SetHistory, topics: []string{topic}, history: historyConfig{size: size, ttl: ttl}})
 }
 
-// Pub 發布訊息 (publish message to subscribe channels)
+// Pub 發布訊息，經由代理送到所有節點 (publish message to subscribe channels of every node through the broker)
 func (ps *pubSub) Pub(msg *envelope, topics ...string) {
-	ps.commandChan <- cmd{opCode: Publish, topics: topics, msg: msg}
+	ps.publish(msg, false, topics...)
 }
 
-// AsyncPub 非同步的發布訊息，內部機制 (async publish message to subscribe channels)
+// AsyncPub 非同步的發布訊息，內部機制 (async publish message to subscribe channels of every node through the broker)
 func (ps *pubSub) AsyncPub(msg *envelope, topics ...string) {
-	ps.commandChan <- cmd{opCode: AsyncPublish, topics: topics, msg: msg}
+	ps.publish(msg, true, topics...)
+}
+
+// withID 複製訊息並加上識別碼，不修改呼叫者的訊息 (copy msg with a new message id, leaving the envelope of the caller untouched)
+func withID(msg *envelope) *envelope {
+	stamped := *msg
+	stamped.id = uuid.NewV4().String()
+	return &stamped
+}
+
+func (ps *pubSub) publish(msg *envelope, isAsync bool, topics ...string) {
+	msg = withID(msg)
+	if _, err := ps.dispatch(context.Background(), msg, isAsync, nil, topics...); err != nil {
+		return
+	}
+
+	if err := ps.forward(msg, isAsync, topics...); err != nil {
+		ps.errorHandler(err)
+	}
+}
+
+// PubContext 發布訊息並等待本節點送達結果 (publish message and wait for the local delivery result, gives up when ctx is done)
+func (ps *pubSub) PubContext(ctx context.Context, msg *envelope, isAsync bool, topics ...string) (*PublishResult, error) {
+	msg = withID(msg)
+	result := make(chan *PublishResult, len(ps.workers))
+	sent, err := ps.dispatch(ctx, msg, isAsync, result, topics...)
+	if err == nil {
+		err = ps.forward(msg, isAsync, topics...)
+	}
+
+	res := &PublishResult{}
+	for i := 0; i < sent; i++ {
+		part := <-result
+		res.Delivered += part.Delivered
+		res.Dropped += part.Dropped
+	}
+
+	if err == nil && res.Dropped > 0 {
+		err = ctx.Err()
+	}
+
+	return res, err
+}
+
+// dispatch 交給本地訂閱者，回傳收到訊息的worker數量 (hand the message to the local subscribe channels, returns how many workers took it)
+func (ps *pubSub) dispatch(ctx context.Context, msg *envelope, isAsync bool, result chan *PublishResult, topics ...string) (int, error) {
+	op := Publish
+	if isAsync {
+		op = AsyncPublish
+	}
+
+	sent := 0
+	for w, part := range ps.route(op, topics) {
+		select {
+		case w.commandChan <- cmd{opCode: op, topics: part, msg: msg, ctx: ctx, result: result}:
+			sent++
+		case <-ctx.Done():
+			return sent, ctx.Err()
+		case <-w.done:
+			return sent, ErrPubSubShutdown
+		}
+	}
+
+	return sent, nil
+}
+
+// forward 經由代理送到其他節點 (forward the message to the other nodes through the broker)
+func (ps *pubSub) forward(msg *envelope, isAsync bool, topics ...string) error {
+	var firstErr error
+	for _, topic := range topics {
+		bm := &BrokerMessage{Origin: ps.nodeID, ID: msg.id, Topic: topic, Type: msg.t, Data: msg.msg, Async: isAsync}
+		if err := ps.broker.Publish(bm); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+
+	return firstErr
+}
+
+// deliver 將其他節點的訊息發給本地訂閱者 (deliver a broker message of another node to the local subscribe channels)
+func (ps *pubSub) deliver(bm *BrokerMessage) {
+	if bm.Origin == ps.nodeID {
+		return
+	}
+
+	op := Publish
+	if bm.Async {
+		op = AsyncPublish
+	}
+
+	msg := &envelope{t: bm.Type, msg: bm.Data, id: bm.ID}
+	ps.send(cmd{opCode: op, topics: []string{bm.Topic}, msg: msg, ctx: context.Background()})
 }
 
 // Unsub 取消訂閱  (unsubscribe topic, if topics is null, it will unsubscribe all)
 func (ps *pubSub) Unsub(ch chan *envelope, topics ...string) {
 	// 如果不寫topic，視為將全部topic都取消訂閱
 	if len(topics) == 0 {
-		ps.commandChan <- cmd{opCode: UnSubscribeAll, ch: ch}
+		ps.send(cmd{opCode: UnSubscribeAll, ch: ch})
 		return
 	}
 
-	ps.commandChan <- cmd{opCode: Unsubscribe, topics: topics, ch: ch}
+	ps.send(cmd{opCode: Unsubscribe, topics: topics, ch: ch})
 }
 
 // Close 關閉Topic, 相關有訂閱的channel都會被取消 (close topics, if channel subscribe it, will auto unsubscribe)
 func (ps *pubSub) Close(topics ...string) {
-	ps.commandChan <- cmd{opCode: CloseTopic, topics: topics}
+	ps.send(cmd{opCode: CloseTopic, topics: topics})
+}
+
+// Topics 目前有訂閱者的主題 (topics and patterns having at least one subscriber)
+func (ps *pubSub) Topics() []string {
+	seen := make(map[string]bool)
+	ps.read(func(reg *register) {
+		for topic := range reg.topics {
+			seen[topic] = true
+		}
+	})
+
+	return sortedKeys(seen)
+}
+
+// Subscribers 會收到此主題訊息的Session (sessions which would receive a message published to topic)
+func (ps *pubSub) Subscribers(topic string) []*Session {
+	var sessions []*Session
+	ps.workerOf(topic).read(func(reg *register) {
+		for ch := range reg.subscribers(topic) {
+			if owner, ok := reg.owners[ch]; ok {
+				sessions = append(sessions, owner)
+			}
+		}
+	})
+
+	return sessions
+}
+
+// Members 直接訂閱此主題的Session (sessions subscribed to topic itself, not through a wildcard pattern)
+func (ps *pubSub) Members(topic string) []*Session {
+	var sessions []*Session
+	ps.workerOf(topic).read(func(reg *register) {
+		for ch := range reg.topics[topic] {
+			if owner, ok := reg.owners[ch]; ok {
+				sessions = append(sessions, owner)
+			}
+		}
+	})
+
+	return sessions
+}
+
+// ChannelTopics channel訂閱的主題 (topics subscribed by the channel)
+func (ps *pubSub) ChannelTopics(ch chan *envelope) []string {
+	seen := make(map[string]bool)
+	ps.read(func(reg *register) {
+		for topic := range reg.revTopics[ch] {
+			seen[topic] = true
+		}
+	})
+
+	return sortedKeys(seen)
+}
+
+// sortedKeys 排序後的主題，去除複製到各worker的萬用字元 (sorted topics, patterns replicated across the workers appear once)
+func sortedKeys(set map[string]bool) []string {
+	keys := make([]string, 0, len(set))
+	for key := range set {
+		keys = append(keys, key)
+	}
+
+	sort.Strings(keys)
+	return keys
+}
+
+// read 依序在每個worker的goroutine中讀取資料 (run fn on the goroutine of every worker in turn)
+func (ps *pubSub) read(fn func(*register)) {
+	for _, w := range ps.workers {
+		w.read(fn)
+	}
+}
+
+// read 在worker的goroutine中讀取資料，避免競爭 (run fn on the worker goroutine so it can read the register race-free)
+func (w *pubSubWorker) read(fn func(*register)) {
+	done := make(chan struct{})
+	if w.send(cmd{opCode: Inspect, inspect: func(reg *register) {
+		fn(reg)
+		close(done)
+	}}) {
+		<-done
+	}
 }
 
 // Shutdown 關閉所有有訂閱的Channel (close all channels)
 func (ps *pubSub) Shutdown() {
-	ps.commandChan <- cmd{opCode: ShutDown}
+	ps.send(cmd{opCode: ShutDown})
 }
 
+// start 啟動所有worker，全部結束後關閉done (run every worker, done is closed once all of them exited)
 func (ps *pubSub) start() {
+	defer close(ps.done)
+
+	var wg sync.WaitGroup
+	for _, w := range ps.workers {
+		wg.Add(1)
+		go func(w *pubSubWorker) {
+			defer wg.Done()
+			ps.run(w)
+		}(w)
+	}
+
+	wg.Wait()
+}
+
+// run 處理worker的指令 (process the commands of worker w)
+func (ps *pubSub) run(w *pubSubWorker) {
+	defer close(w.done)
 
 	// 初始化暫存在記憶體的資料(topicsMap & revertTopicsOfChannelMap)
 	// init register data
 	reg := register{
-		topics:    make(map[string]map[chan *envelope]bool),
-		revTopics: make(map[chan *envelope]map[string]bool),
+		topics:       make(map[string]map[chan *envelope]bool),
+		revTopics:    make(map[chan *envelope]map[string]bool),
+		owners:       make(map[chan *envelope]*Session),
+		wildcards:    newTopicTrie(),
+		seqs:         make(map[string]uint64),
+		framer:       ps.framer,
+		presence:     ps.presence,
+		broker:       ps.broker,
+		errorHandler: ps.errorHandler,
+		metrics:      ps.metrics,
+		slowHandler:  ps.slowHandler,
+		prepare:      ps.prepare,
+		retain:       ps.retain,
+		release:      ps.release,
+		home: func(topic string) bool {
+			return ps.workerOf(topic) == w
+		},
+
+		histories:      make(map[string]*topicHistory),
+		historyConfigs: make(map[string]historyConfig),
+		defaultHistory: ps.history,
+
+		slowConsumers:       make(map[string]SlowConsumer),
+		defaultSlowConsumer: ps.slowConsumer,
 	}
 
 loop:
-	for cmd := range ps.commandChan {
+	for cmd := range w.commandChan {
 		if cmd.topics == nil {
 			switch cmd.opCode {
 			case UnSubscribeAll:
 				reg.removeChannel(cmd.ch)
 
+			case Inspect:
+				cmd.inspect(&reg)
+
 			case ShutDown:
 				break loop
 			}
 
+			if cmd.result != nil {
+				cmd.result <- &PublishResult{}
+			}
+
 			continue loop
 		}
 
+		result := &PublishResult{}
+		replayed := make(map[string][]historyEntry)
 		for _, topic := range cmd.topics {
 			switch cmd.opCode {
 			case Subscribe:
-				reg.add(topic, cmd.ch)
+				reg.add(topic, cmd.ch, cmd.owner)
+				if cmd.replay == nil {
+					break
+				}
+
+				if isTopicPattern(topic) && cmd.replayed != nil {
+					replayed[topic] = reg.matchingHistory(topic, cmd.replay)
+				} else {
+					reg.replay(topic, cmd.ch, cmd.replay)
+				}
 
 			case Publish:
-				reg.send(topic, cmd.msg)
+				reg.send(cmd.ctx, topic, cmd.msg, result)
 
 			case AsyncPublish:
-				reg.sendAsync(topic, cmd.msg)
+				reg.sendAsync(topic, cmd.msg, result)
 
 			case Unsubscribe:
 				reg.remove(topic, cmd.ch)
 
 			case CloseTopic:
 				reg.removeTopic(topic)
+
+			case SetHistory:
+				reg.setHistory(topic, cmd.history)
+
+			case SetSlowConsumer:
+				reg.slowConsumers[topic] = cmd.policy
 			}
 		}
+
+		if cmd.result != nil {
+			cmd.result <- result
+		}
+		if cmd.replayed != nil {
+			cmd.replayed <- replayed
+		}
 	}
 
 	// 當跳出迴圈要結束時，將所有未關閉的topic channel進行移除
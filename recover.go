@@ -0,0 +1,22 @@
+package melody
+
+import "runtime/debug"
+
+// safe 執行使用者的handler，panic時回傳PanicError (run a user handler, turning a panic into a PanicError)
+func safe(fn func()) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = &PanicError{Value: r, Stack: debug.Stack()}
+		}
+	}()
+
+	fn()
+
+	return nil
+}
+
+// panicked 回報panic並以1011關閉Session (report the panic and close the session with 1011)
+func (s *Session) panicked(err error) {
+	s.melody.errorHandler(s, err)
+	s.CloseWithMsg(FormatCloseMessage(CloseInternalServerErr, "internal error"))
+}
@@ -1,18 +1,71 @@
 package melody
 
+import "context"
+
 // register
 // topics    Key: topic  , Value: 有訂閱此Topic的ChannelMap
 // revTopics Key: Channel, Value: 訂閱了哪些Topic
+// owners    Key: Channel, Value: 擁有此Channel的Session
+// wildcards 萬用字元訂閱的前綴樹 (trie of the wildcard patterns in topics)
+// histories Key: topic  , Value: 此Topic最近發布的訊息 (recently published messages)
+// seqs      Key: topic  , Value: 此Topic最後的序號 (last sequence number handed out, only kept while the topic has subscribers or history)
+// broker    第一個訂閱者出現時訂閱，最後一個離開時取消 (subscribed on first local subscriber, unsubscribed on last)
+// 每個worker各有一個register，萬用字元訂閱複製到所有worker (one register per worker, wildcard patterns are replicated to all of them)
 type register struct {
-	topics    map[string]map[chan *envelope]bool
-	revTopics map[chan *envelope]map[string]bool
+	topics       map[string]map[chan *envelope]bool
+	revTopics    map[chan *envelope]map[string]bool
+	owners       map[chan *envelope]*Session
+	wildcards    *topicTrie
+	seqs         map[string]uint64
+	framer       func(*Message) []byte        // 主題訊息封裝 (frames topic messages, may be nil)
+	presence     func(*Session, string, bool) // Session加入/離開主題 (session joined or left a topic)
+	broker       Broker
+	errorHandler func(error)
+	metrics      Metrics
+	slowHandler  func(*Session, string, SlowConsumerPolicy)
+	retain       func(chan *envelope) bool // 新增channel的訂閱，channel已關閉時回傳false (count a subscription of the channel, false once it was closed)
+	release      func(chan *envelope)      // 移除channel的訂閱，最後一個時關閉channel (uncount a subscription of the channel, the last one closes it)
+	prepare      bool                      // 預先編碼frame，批次寫入時不使用 (prepare frames once per publish, off when batching)
+	home         func(string) bool         // 主題是否屬於此worker，萬用字元只在所屬worker觸發事件 (whether topic hashes to this worker, replicated patterns only report on their home worker)
+
+	histories      map[string]*topicHistory
+	historyConfigs map[string]historyConfig // 個別主題的歷史設定 (per-topic history settings)
+	defaultHistory historyConfig            // 其他主題的歷史設定 (history settings of the other topics)
+
+	slowConsumers       map[string]SlowConsumer // 個別主題的慢速消費者策略 (per-topic slow consumer policies)
+	defaultSlowConsumer *SlowConsumer           // 其他主題的策略，nil維持原本行為 (policy of the other topics, nil keeps the legacy behaviour)
 }
 
-func (reg *register) add(topic string, ch chan *envelope) {
+func (reg *register) add(topic string, ch chan *envelope, owner *Session) {
+	if _, ok := reg.topics[topic][ch]; !ok && !reg.retain(ch) {
+		return
+	}
+
+	if owner != nil {
+		reg.owners[ch] = owner
+	}
+
+	home := reg.home(topic)
 	if reg.topics[topic] == nil {
 		reg.topics[topic] = make(map[chan *envelope]bool)
+		if isTopicPattern(topic) {
+			reg.wildcards.insert(topic)
+		}
+		if home {
+			if err := reg.broker.Subscribe(topic); err != nil {
+				reg.errorHandler(err)
+			}
+		}
+	}
+	if _, ok := reg.topics[topic][ch]; !ok {
+		reg.topics[topic][ch] = true
+		if home {
+			if owner, ok := reg.owners[ch]; ok {
+				reg.presence(owner, topic, true)
+			}
+			reg.metrics.TopicSubscribers(topic, len(reg.topics[topic]))
+		}
 	}
-	reg.topics[topic][ch] = true
 
 	if reg.revTopics[ch] == nil {
 		reg.revTopics[ch] = make(map[string]bool)
@@ -20,26 +73,155 @@ func (reg *register) add(topic string, ch chan *envelope) {
 	reg.revTopics[ch][topic] = true
 }
 
-func (reg *register) send(topic string, msg *envelope) {
+// subscribers 直接訂閱或以萬用字元訂閱此主題的channel (channels subscribed to topic directly or through a wildcard pattern)
+func (reg *register) subscribers(topic string) map[chan *envelope]bool {
+	patterns := reg.wildcards.match(topic)
+	if len(patterns) == 0 {
+		return reg.topics[topic]
+	}
+
+	chans := make(map[chan *envelope]bool, len(reg.topics[topic]))
 	for ch := range reg.topics[topic] {
-		ch <- msg
+		chans[ch] = true
+	}
+	for _, pattern := range patterns {
+		for ch := range reg.topics[pattern] {
+			chans[ch] = true
+		}
 	}
+
+	return chans
 }
 
-func (reg *register) sendAsync(topic string, msg *envelope) {
-	for ch := range reg.topics[topic] {
-		select {
-		case ch <- msg:
-		default:
+// stamp 複製訊息並加上主題序號，有訂閱者且未批次寫入時只編碼一次
+// (copy msg for topic with the next sequence number, framing it once for every subscriber when there are any and batching is off)
+func (reg *register) stamp(topic string, msg *envelope, subscribed bool) *envelope {
+	reg.seqs[topic]++
+	stamped := &envelope{t: msg.t, msg: msg.msg, topic: topic, seq: reg.seqs[topic], id: msg.id, priority: PriorityTopic}
+
+	if reg.framer != nil {
+		stamped.raw = msg.msg
+		stamped.msg = reg.framer(stamped.message())
+	}
+
+	if !subscribed || !reg.prepare {
+		return stamped
+	}
+
+	return stamped.prepare()
+}
+
+// send 等待緩衝區有空間，直到 ctx 結束 (wait for buffer space of every subscriber until ctx is done)
+func (reg *register) send(ctx context.Context, topic string, msg *envelope, result *PublishResult) {
+	delivered, dropped := 0, 0
+	subscribers := reg.subscribers(topic)
+	msg = reg.stamp(topic, msg, len(subscribers) > 0)
+	for ch := range subscribers {
+		if reg.deliver(ctx, topic, ch, msg) {
+			delivered++
+		} else {
+			dropped++
 		}
+	}
 
+	reg.published(topic, delivered, dropped, result)
+	reg.record(topic, msg)
+	if len(subscribers) == 0 {
+		reg.forget(topic)
 	}
 }
 
+func (reg *register) sendAsync(topic string, msg *envelope, result *PublishResult) {
+	delivered, dropped := 0, 0
+	subscribers := reg.subscribers(topic)
+	msg = reg.stamp(topic, msg, len(subscribers) > 0)
+	for ch := range subscribers {
+		if reg.deliver(nil, topic, ch, msg) {
+			delivered++
+		} else {
+			dropped++
+		}
+	}
+
+	reg.published(topic, delivered, dropped, result)
+	reg.record(topic, msg)
+	if len(subscribers) == 0 {
+		reg.forget(topic)
+	}
+}
+
+// forget 主題沒有訂閱者也沒有歷史時移除序號，避免發布到大量短暫主題時seqs無限增長
+// (drop the sequence number of topic once it has neither subscribers nor history, so publishing to many short-lived topics does not grow seqs)
+func (reg *register) forget(topic string) {
+	if _, ok := reg.histories[topic]; ok {
+		return
+	}
+	if len(reg.subscribers(topic)) > 0 {
+		return
+	}
+
+	delete(reg.seqs, topic)
+}
+
+// slowConsumerOf 主題的慢速消費者策略 (slow consumer policy of topic, nil for the legacy behaviour)
+func (reg *register) slowConsumerOf(topic string) *SlowConsumer {
+	if policy, ok := reg.slowConsumers[topic]; ok {
+		return &policy
+	}
+
+	return reg.defaultSlowConsumer
+}
+
+// deliver 放入訂閱者的channel，已滿時依策略處理，ctx為nil表示非同步發布
+// (put msg into the channel of a subscriber, applying the slow consumer policy if it is full; a nil ctx means an async publish)
+func (reg *register) deliver(ctx context.Context, topic string, ch chan *envelope, msg *envelope) bool {
+	owner := reg.owners[ch]
+	policy := reg.slowConsumerOf(topic)
+
+	select {
+	case ch <- msg:
+		if owner != nil {
+			owner.supersede(policy, msg)
+		}
+		return true
+	default:
+	}
+
+	if policy == nil {
+		if ctx != nil {
+			select {
+			case ch <- msg:
+				return true
+			case <-ctx.Done():
+				select {
+				case ch <- msg:
+					return true
+				default:
+				}
+			}
+		}
+
+		policy = &SlowConsumer{Policy: DropNewest}
+	}
+
+	reg.slowHandler(owner, topic, policy.Policy)
+
+	return overflow(ch, owner, msg, *policy)
+}
+
+// published 累計發布結果 (add the outcome of publishing to topic to result and the metrics)
+func (reg *register) published(topic string, delivered, dropped int, result *PublishResult) {
+	result.Delivered += delivered
+	result.Dropped += dropped
+	reg.metrics.TopicPublished(topic, delivered, dropped)
+}
+
 func (reg *register) removeTopic(topic string) {
 	for ch := range reg.topics[topic] {
 		reg.remove(topic, ch)
 	}
+	delete(reg.histories, topic)
+	reg.forget(topic)
 }
 
 func (reg *register) removeChannel(ch chan *envelope) {
@@ -60,12 +242,37 @@ func (reg *register) remove(topic string, ch chan *envelope) {
 	delete(reg.topics[topic], ch)
 	delete(reg.revTopics[ch], topic)
 
+	home := reg.home(topic)
+	if home {
+		reg.metrics.TopicSubscribers(topic, len(reg.topics[topic]))
+		if owner, ok := reg.owners[ch]; ok {
+			reg.presence(owner, topic, false)
+		}
+	}
+
 	if len(reg.topics[topic]) == 0 {
 		delete(reg.topics, topic)
+		if isTopicPattern(topic) {
+			reg.wildcards.remove(topic)
+			for name := range reg.seqs {
+				if matchTopic(topic, name) {
+					reg.forget(name)
+				}
+			}
+		} else {
+			reg.forget(topic)
+		}
+		if home {
+			if err := reg.broker.Unsubscribe(topic); err != nil {
+				reg.errorHandler(err)
+			}
+		}
 	}
 
 	if len(reg.revTopics[ch]) == 0 {
-		close(ch)
 		delete(reg.revTopics, ch)
+		delete(reg.owners, ch)
 	}
+
+	reg.release(ch)
 }
@@ -0,0 +1,163 @@
+package melody
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// ResumeTokenParam is the query parameter a reconnecting client presents its resume token in,
+// e.g. ws://host/ws?resume_token=<token>.
+const ResumeTokenParam = "resume_token"
+
+// parkedSession 斷線後等待重連的Session (a disconnected session waiting to be resumed)
+type parkedSession struct {
+	session *Session
+	timer   *time.Timer
+}
+
+// DialResumeTimeout keep a session whose connection dropped without a close frame for timeout,
+// so a client reconnecting with Session.ResumeToken in the ResumeTokenParam query parameter gets
+// the same session back, with its hashID, Keys and topics, and every message written to it
+// while it was offline. A timeout of 0 disables resumption.
+func DialResumeTimeout(timeout time.Duration) DialOption {
+	return DialOption{func(do *dialOptions) {
+		do.resumeTimeout = timeout
+	}}
+}
+
+// HandleResume fires fn when a parked session is resumed by a new connection.
+func (m *Melody) HandleResume(fn func(*Session)) {
+	m.resumeHandler = fn
+}
+
+// park 保留斷線的Session直到逾時 (keep the disconnected session until the resume timeout)
+func (m *Melody) park(s *Session) {
+	p := &parkedSession{session: s}
+
+	m.parkedMutex.Lock()
+	m.parked[s.resumeToken] = p
+	p.timer = time.AfterFunc(m.resumeTimeout, func() {
+		if m.unpark(s.resumeToken) != nil {
+			m.finish(s)
+		}
+	})
+	m.parkedMutex.Unlock()
+}
+
+// unpark 取出等待重連的Session (take the parked session of token, nil if there is none)
+func (m *Melody) unpark(token string) *Session {
+	m.parkedMutex.Lock()
+	defer m.parkedMutex.Unlock()
+
+	p, ok := m.parked[token]
+	if !ok {
+		return nil
+	}
+
+	p.timer.Stop()
+	delete(m.parked, token)
+	return p.session
+}
+
+// resumeRequest 以重連token取出Session (the parked session a request asks to resume, nil if none)
+func (m *Melody) resumeRequest(r *http.Request) *Session {
+	if m.resumeTimeout <= 0 {
+		return nil
+	}
+
+	token := r.URL.Query().Get(ResumeTokenParam)
+	if token == "" {
+		return nil
+	}
+
+	return m.unpark(token)
+}
+
+// shouldPark 連線是否非預期中斷 (whether the connection dropped without the session being closed on purpose)
+func (s *Session) shouldPark(readErr error) bool {
+	if s.melody.resumeTimeout <= 0 || s.melody.hub.closed() {
+		return false
+	}
+
+	if websocket.IsCloseError(readErr, websocket.CloseNormalClosure, websocket.CloseGoingAway) {
+		return false
+	}
+
+	s.rwmutex.RLock()
+	defer s.rwmutex.RUnlock()
+	return s.open && !s.closing
+}
+
+// ResumeToken returns the secret a client presents to resume this session after its connection dropped.
+// It is empty unless resumption is enabled with DialResumeTimeout.
+func (s *Session) ResumeToken() string {
+	return s.resumeToken
+}
+
+// park 停止寫入並開始暫存訂閱的訊息 (stop writing to the dropped connection and buffer topic messages until resumed)
+func (s *Session) park() {
+	s.rwmutex.Lock()
+	s.parked = true
+	s.conn.Close()
+	close(s.closeOutputChan)
+	s.parkStop = make(chan struct{})
+	s.parkDone = make(chan struct{})
+	s.rwmutex.Unlock()
+
+	<-s.writeDone
+	go s.parkPump(s.parkStop, s.parkDone)
+}
+
+// parkPump 斷線期間將訂閱訊息移到output (move topic messages into output while the session is offline)
+func (s *Session) parkPump(stop, done chan struct{}) {
+	defer close(done)
+
+	for {
+		select {
+		case <-stop:
+			return
+		case msg, ok := <-s.subChan:
+			if !ok {
+				return
+			}
+			// 暫存在output，不放回subChan (buffer in output instead of putting it back into subChan)
+			buffered := *msg
+			buffered.priority = PriorityDirect
+			s.writeMessage(&buffered)
+		}
+	}
+}
+
+// unpark 停止暫存訂閱訊息，回傳是否曾經暫停 (stop parkPump, returns whether the session was parked)
+func (s *Session) unpark() bool {
+	s.rwmutex.RLock()
+	parked, stop, done := s.parked, s.parkStop, s.parkDone
+	s.rwmutex.RUnlock()
+
+	if !parked {
+		return false
+	}
+
+	close(stop)
+	<-done
+
+	s.rwmutex.Lock()
+	s.parked = false
+	s.rwmutex.Unlock()
+	return true
+}
+
+// resume 綁定新的連線 (bind the new connection to the parked session)
+func (s *Session) resume(conn *websocket.Conn, r *http.Request) {
+	s.unpark()
+
+	s.rwmutex.Lock()
+	defer s.rwmutex.Unlock()
+
+	s.conn = conn
+	s.Request = r
+	s.closeOutputChan = make(chan struct{})
+	s.writeDone = make(chan struct{})
+}
@@ -0,0 +1,220 @@
+package melody
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"sync"
+
+	"github.com/gorilla/websocket"
+)
+
+// EventFormat 事件訊息格式 (envelope format of routed messages)
+type EventFormat interface {
+	// Decode 取出事件名稱與內文 (split an incoming message into the event name and its data)
+	Decode(msg []byte) (event string, data []byte, err error)
+	// Unmarshal 將內文解碼到handler的參數 (decode the data into the request argument of a handler)
+	Unmarshal(data []byte, v interface{}) error
+	// Encode 封裝回覆，handler失敗時err不為nil (encode the reply of a handler, err is set if it failed)
+	Encode(event string, data interface{}, err error) ([]byte, error)
+}
+
+// jsonEventFrame JSONEventFormat 的格式 (frame of JSONEventFormat)
+type jsonEventFrame struct {
+	Event string          `json:"event"`
+	Data  json.RawMessage `json:"data,omitempty"`
+	Error string          `json:"error,omitempty"`
+}
+
+// JSONEventFormat is the default EventFormat, messages look like {"event":"join","data":{...}}
+// and failed handlers are answered with {"event":"join","error":"..."}.
+type JSONEventFormat struct{}
+
+// Decode implements EventFormat.
+func (JSONEventFormat) Decode(msg []byte) (string, []byte, error) {
+	var frame jsonEventFrame
+	if err := json.Unmarshal(msg, &frame); err != nil {
+		return "", nil, err
+	}
+
+	return frame.Event, frame.Data, nil
+}
+
+// Unmarshal implements EventFormat.
+func (JSONEventFormat) Unmarshal(data []byte, v interface{}) error {
+	if len(data) == 0 {
+		return nil
+	}
+
+	return json.Unmarshal(data, v)
+}
+
+// Encode implements EventFormat.
+func (JSONEventFormat) Encode(event string, data interface{}, err error) ([]byte, error) {
+	frame := jsonEventFrame{Event: event}
+	if err != nil {
+		frame.Error = err.Error()
+		return json.Marshal(frame)
+	}
+
+	raw, err := json.Marshal(data)
+	if err != nil {
+		return nil, err
+	}
+	frame.Data = raw
+
+	return json.Marshal(frame)
+}
+
+var (
+	sessionType = reflect.TypeOf(&Session{})
+	errorType   = reflect.TypeOf((*error)(nil)).Elem()
+)
+
+// route 已註冊的事件處理函式 (a registered event handler)
+type route struct {
+	fn      reflect.Value
+	reqType reflect.Type // 請求參數型別 (type of the request argument)
+	reply   bool         // 是否有回覆值 (whether the handler returns a reply value)
+}
+
+// router 依照事件名稱分派訊息 (dispatches messages to handlers by event name)
+type router struct {
+	mutex    *sync.RWMutex
+	format   EventFormat
+	routes   map[string]*route
+	fallback func(*Session, string, []byte)
+}
+
+func newRouter() *router {
+	return &router{
+		mutex:  &sync.RWMutex{},
+		format: JSONEventFormat{},
+		routes: make(map[string]*route),
+	}
+}
+
+// newRoute 檢查handler的型別 (validate the signature of a handler)
+func newRoute(handler interface{}) (*route, error) {
+	fn := reflect.ValueOf(handler)
+	if !fn.IsValid() || fn.Kind() != reflect.Func {
+		return nil, errors.New("melody: handler must be a func")
+	}
+
+	t := fn.Type()
+	if t.NumIn() != 2 || t.In(0) != sessionType {
+		return nil, errors.New("melody: handler must be func(*Session, Req) with optional (Resp, error) or error results")
+	}
+
+	r := &route{fn: fn, reqType: t.In(1)}
+	switch {
+	case t.NumOut() == 0:
+	case t.NumOut() == 1 && t.Out(0) == errorType:
+	case t.NumOut() == 2 && t.Out(1) == errorType:
+		r.reply = true
+	default:
+		return nil, errors.New("melody: handler must return nothing, error or (Resp, error)")
+	}
+
+	return r, nil
+}
+
+func (rt *router) dispatch(s *Session, messageType int, msg []byte) {
+	rt.mutex.RLock()
+	format, fallback := rt.format, rt.fallback
+	rt.mutex.RUnlock()
+
+	event, data, err := format.Decode(msg)
+	if err != nil {
+		s.melody.errorHandler(s, err)
+		return
+	}
+
+	rt.mutex.RLock()
+	r, ok := rt.routes[event]
+	rt.mutex.RUnlock()
+
+	if !ok {
+		if fallback != nil {
+			fallback(s, event, data)
+		} else {
+			s.melody.errorHandler(s, fmt.Errorf("melody: no handler for event %q", event))
+		}
+		return
+	}
+
+	req := reflect.New(r.reqType)
+	if err := format.Unmarshal(data, req.Interface()); err != nil {
+		rt.reply(s, format, messageType, event, nil, err)
+		return
+	}
+
+	out := r.fn.Call([]reflect.Value{reflect.ValueOf(s), req.Elem()})
+	if len(out) == 0 {
+		return
+	}
+
+	if errValue := out[len(out)-1]; !errValue.IsNil() {
+		rt.reply(s, format, messageType, event, nil, errValue.Interface().(error))
+		return
+	}
+
+	if r.reply {
+		rt.reply(s, format, messageType, event, out[0].Interface(), nil)
+	}
+}
+
+func (rt *router) reply(s *Session, format EventFormat, messageType int, event string, data interface{}, handlerErr error) {
+	msg, err := format.Encode(event, data, handlerErr)
+	if err != nil {
+		s.melody.errorHandler(s, err)
+		return
+	}
+
+	s.writeMessage(&envelope{t: messageType, msg: msg})
+}
+
+// On routes messages of event to handler and installs the router as the text and binary
+// message handler. handler must look like one of
+//
+//	func(s *Session, req Req)
+//	func(s *Session, req Req) error
+//	func(s *Session, req Req) (Resp, error)
+//
+// The data of the message is decoded into req with the EventFormat (JSONEventFormat by
+// default). Resp is encoded and sent back with the same event name and the frame type of
+// the request; a returned or decoding error is sent back as an error reply instead.
+// On panics if handler does not have one of these signatures.
+func (m *Melody) On(event string, handler interface{}) {
+	r, err := newRoute(handler)
+	if err != nil {
+		panic(err)
+	}
+
+	m.router.mutex.Lock()
+	m.router.routes[event] = r
+	m.router.mutex.Unlock()
+
+	m.HandleMessage(func(s *Session, msg []byte) {
+		m.router.dispatch(s, websocket.TextMessage, msg)
+	})
+	m.HandleMessageBinary(func(s *Session, msg []byte) {
+		m.router.dispatch(s, websocket.BinaryMessage, msg)
+	})
+}
+
+// OnUnknown fires fn with the event name and raw data of routed messages without a handler.
+// By default they are reported to HandleError.
+func (m *Melody) OnUnknown(fn func(*Session, string, []byte)) {
+	m.router.mutex.Lock()
+	defer m.router.mutex.Unlock()
+	m.router.fallback = fn
+}
+
+// SetEventFormat replaces the EventFormat used by the handlers registered with On.
+func (m *Melody) SetEventFormat(format EventFormat) {
+	m.router.mutex.Lock()
+	defer m.router.mutex.Unlock()
+	m.router.format = format
+}
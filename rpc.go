@@ -0,0 +1,174 @@
+package melody
+
+import (
+	"context"
+	"encoding/json"
+
+	uuid "github.com/satori/go.uuid"
+
+	"github.com/gorilla/websocket"
+)
+
+// RPC frame kinds carried by rpcFrame.RPC.
+const (
+	rpcRequest  = "request"
+	rpcResponse = "response"
+)
+
+// rpcFrame 請求/回應的文字訊息格式 (text frame of a request or a response)
+//
+//	{"rpc":"request","id":"<id>","data":<payload>}
+//	{"rpc":"response","id":"<id>","data":<payload>,"error":"<message>"}
+//
+// Payloads are JSON values and are passed to handlers as raw JSON.
+type rpcFrame struct {
+	RPC   string          `json:"rpc"`
+	ID    string          `json:"id"`
+	Data  json.RawMessage `json:"data,omitempty"`
+	Error string          `json:"error,omitempty"`
+}
+
+// RPCError is returned by Session.SendRequest when the peer answered with an error.
+type RPCError struct {
+	Message string
+}
+
+func (e *RPCError) Error() string {
+	return e.Message
+}
+
+type handleRequestMessageFunc func(*Session, []byte) ([]byte, error)
+
+// HandleRequestMessage fires fn for every request a client sends with {"rpc":"request",...}
+// and answers it with the returned payload, or with the error message if fn fails.
+// fn runs on its own goroutine, so it may itself call Session.SendRequest.
+func (m *Melody) HandleRequestMessage(fn func(*Session, []byte) ([]byte, error)) {
+	m.requestMessageHandler = fn
+}
+
+// SendRequest sends payload, which must be valid JSON, to the client as {"rpc":"request",...}
+// and waits for the response frame with the same id. It returns ctx.Err() if no response
+// arrives before ctx is done, and an *RPCError if the client answered with an error.
+func (s *Session) SendRequest(ctx context.Context, payload []byte) ([]byte, error) {
+	if !json.Valid(payload) {
+		return nil, ErrInvalidRPCPayload
+	}
+
+	id := uuid.NewV4().String()
+	reply := make(chan *rpcFrame, 1)
+
+	s.rpcMutex.Lock()
+	if s.pending == nil {
+		s.rpcMutex.Unlock()
+		return nil, ErrRequestSessionClosed
+	}
+	s.pending[id] = reply
+	s.rpcMutex.Unlock()
+
+	defer func() {
+		s.rpcMutex.Lock()
+		delete(s.pending, id)
+		s.rpcMutex.Unlock()
+	}()
+
+	if err := s.writeRPC(&rpcFrame{RPC: rpcRequest, ID: id, Data: payload}); err != nil {
+		return nil, err
+	}
+
+	select {
+	case frame, ok := <-reply:
+		if !ok {
+			return nil, ErrRequestSessionClosed
+		}
+
+		if frame.Error != "" {
+			return nil, &RPCError{Message: frame.Error}
+		}
+
+		return frame.Data, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+func (s *Session) writeRPC(frame *rpcFrame) error {
+	data, err := json.Marshal(frame)
+	if err != nil {
+		return err
+	}
+
+	return s.queue(&envelope{t: websocket.TextMessage, msg: data, priority: PriorityControl})
+}
+
+// handleRPC 處理請求/回應訊息，不是的話回傳false (handle a request or response frame, returns false for other messages)
+func (s *Session) handleRPC(message []byte) bool {
+	s.rpcMutex.Lock()
+	waiting := len(s.pending) > 0
+	s.rpcMutex.Unlock()
+
+	handler := s.melody.requestMessageHandler
+	if handler == nil && !waiting {
+		return false
+	}
+
+	var frame rpcFrame
+	if err := json.Unmarshal(message, &frame); err != nil || frame.ID == "" {
+		return false
+	}
+
+	switch frame.RPC {
+	case rpcResponse:
+		s.rpcMutex.Lock()
+		if reply, ok := s.pending[frame.ID]; ok {
+			select {
+			case reply <- &frame:
+			default:
+			}
+		}
+		s.rpcMutex.Unlock()
+	case rpcRequest:
+		if handler == nil {
+			return false
+		}
+
+		go func() {
+			resp := &rpcFrame{RPC: rpcResponse, ID: frame.ID}
+
+			var data []byte
+			var err error
+			if panicErr := safe(func() {
+				data, err = handler(s, frame.Data)
+			}); panicErr != nil {
+				s.panicked(panicErr)
+				return
+			}
+
+			if err != nil {
+				resp.Error = err.Error()
+			} else if data != nil && !json.Valid(data) {
+				resp.Error = ErrInvalidRPCPayload.Error()
+			} else {
+				resp.Data = data
+			}
+
+			if err := s.writeRPC(resp); err != nil {
+				s.melody.errorHandler(s, err)
+			}
+		}()
+	default:
+		return false
+	}
+
+	return true
+}
+
+// failRequests 連線關閉時結束所有等待中的請求 (release every pending request once the session is closed)
+func (s *Session) failRequests() {
+	s.rpcMutex.Lock()
+	defer s.rpcMutex.Unlock()
+
+	for _, reply := range s.pending {
+		close(reply)
+	}
+	s.pending = nil
+}
@@ -3,6 +3,8 @@ package melody
 import (
 	"errors"
 	"net/http"
+	"strconv"
+	"strings"
 	"sync"
 	"time"
 
@@ -15,13 +17,24 @@ type Session struct {
 	Keys            map[string]interface{}
 	keymutex        *sync.RWMutex
 	conn            *websocket.Conn
-	output          chan *envelope
+	output          chan *envelope // 直接訊息 (direct messages, PriorityDirect)
+	control         chan *envelope // 控制訊息 (control messages, PriorityControl)
 	closeOutputChan chan struct{}
 	melody          *Melody
 	open            bool
 	hashID          string
 	rwmutex         *sync.RWMutex
 	subChan         chan *envelope
+	writeDone       chan struct{} // writePump 結束時關閉 (closed when writePump returns)
+	done            chan struct{} // Session關閉時關閉 (closed once the session is closed)
+	coalesced       *coalescer    // 緩衝區已滿時合併的訊息 (messages coalesced while the buffers are full)
+	closing         bool          // 已要求關閉 (Close was called, the session must not be parked)
+	resumeToken     string        // 重連用的token (secret used to resume the session)
+	parked          bool          // 斷線等待重連中 (connection dropped, waiting to be resumed)
+	parkStop        chan struct{}
+	parkDone        chan struct{}
+	rpcMutex        *sync.Mutex
+	pending         map[string]chan *rpcFrame // 等待回應的請求 (requests waiting for a response, nil once closed)
 }
 
 // GetHashID 取得 HashID (Get Session HashID)
@@ -43,6 +56,15 @@ func (s *Session) AddSub(topicNames ...string) {
 	}
 }
 
+// AddSubReplay 訂閱並重播保留的歷史訊息 (Session subscribe topics and replay the messages kept by the topic history)
+func (s *Session) AddSubReplay(replay *Replay, topicNames ...string) {
+	if s.subChan != nil {
+		s.melody.pubsub.AddSubReplay(s.subChan, replay, topicNames...)
+	} else {
+		s.melody.errorHandler(s, errors.New("error of add current channel,"+strings.Join(topicNames, ",")))
+	}
+}
+
 // UnSub (Session unsubscribe one or multi topics, if no topics ,will unsubscribe all topics)
 func (s *Session) UnSub(topicNames ...string) {
 	if s.subChan != nil {
@@ -57,24 +79,58 @@ func (s *Session) UnSub(topicNames ...string) {
 	}
 }
 
+// Topics 取得訂閱的主題 (topics and wildcard patterns subscribed by the session)
+func (s *Session) Topics() []string {
+	return s.melody.pubsub.ChannelTopics(s.subChan)
+}
+
 func (s *Session) writeMessage(message *envelope) {
+	if err := s.queue(message); err != nil {
+		s.melody.errorHandler(s, err)
+	}
+}
+
+// queue 依優先順序放入佇列，回傳失敗原因 (put message into the queue of its priority, returns why it was dropped)
+func (s *Session) queue(message *envelope) (err error) {
 
 	defer func() {
 		if recover() != nil {
-			s.melody.errorHandler(s, ErrWriteToCloseSessionForRecover)
+			err = ErrWriteToCloseSessionForRecover
 		}
 	}()
 
 	if s.closed() {
-		s.melody.errorHandler(s, ErrWriteToCloseSession)
-		return
+		return ErrWriteToCloseSession
+	}
+
+	ch := s.output
+	switch message.priority {
+	case PriorityControl:
+		ch = s.control
+	case PriorityTopic:
+		ch = s.subChan
 	}
 
 	select {
-	case s.output <- message:
+	case ch <- message:
+		s.supersede(s.melody.slowConsumer, message)
+		return nil
 	default:
-		s.melody.errorHandler(s, ErrSessionMessageBufferIsFull)
 	}
+
+	policy := SlowConsumer{Policy: DropNewest}
+	if s.melody.slowConsumer != nil {
+		policy = *s.melody.slowConsumer
+	}
+
+	s.melody.reportSlowConsumer(s, "", policy.Policy)
+
+	if overflow(ch, s, message, policy) {
+		return nil
+	}
+
+	s.melody.metrics.MessageDropped(message.t)
+	return ErrSessionMessageBufferIsFull
 }
 
 func (s *Session) writeRaw(message *envelope) error {
@@ -83,7 +139,13 @@ func (s *Session) writeRaw(message *envelope) error {
 	}
 
 	s.conn.SetWriteDeadline(time.Now().Add(s.melody.Config.WriteWait))
-	err := s.conn.WriteMessage(message.t, message.msg)
+
+	var err error
+	if message.prepared != nil {
+		err = s.conn.WritePreparedMessage(message.prepared)
+	} else {
+		err = s.conn.WriteMessage(message.t, message.msg)
+	}
 
 	if err != nil {
 		return err
@@ -100,99 +162,161 @@ func (s *Session) closed() bool {
 }
 
 func (s *Session) close() {
+	wasParked := s.unpark()
+
 	if !s.closed() {
 		s.rwmutex.Lock()
 		if s.open {
 			s.conn.Close()
-			close(s.closeOutputChan)
+			if !wasParked {
+				close(s.closeOutputChan)
+			}
 			s.melody.pubsub.Unsub(s.subChan)
+			s.failRequests()
+			close(s.done)
 		}
 		s.open = false
 		s.rwmutex.Unlock()
 	}
 }
 
+// ping 內容為送出時間，用來計算RTT (the payload carries the send time, echoed back by the pong to measure the RTT)
 func (s *Session) ping() {
-	s.writeRaw(&envelope{t: websocket.PingMessage, msg: []byte{}})
+	s.writeRaw(&envelope{t: websocket.PingMessage, msg: []byte(strconv.FormatInt(time.Now().UnixNano(), 10))})
 }
 
 func (s *Session) writePump() {
+	defer close(s.writeDone)
+
 	ticker := time.NewTicker(s.melody.Config.PingPeriod)
 	defer ticker.Stop()
 
+	coalesced := false
+
 loop:
 	for {
+		// 緩衝區清空後才送出合併的訊息，避免被較舊的訊息覆蓋
+		// (send coalesced messages once the buffers are empty, so older queued messages cannot overtake them)
+		if coalesced && len(s.control) == 0 && len(s.output) == 0 && len(s.subChan) == 0 {
+			coalesced = false
+			for _, msg := range s.takeCoalesced() {
+				if !s.writeQueued(msg) {
+					break loop
+				}
+			}
+		}
+
+		select {
+		case <-s.closeOutputChan:
+			break loop
+		default:
+		}
+
+		// 依優先順序取出訊息：控制 > 直接 > 主題 (take queued messages by priority: control > direct > topic)
+		select {
+		case msg := <-s.control:
+			if !s.writeQueued(msg) {
+				break loop
+			}
+			continue loop
+		default:
+		}
+
+		select {
+		case msg := <-s.output:
+			if !s.writeData(msg) {
+				break loop
+			}
+			continue loop
+		default:
+		}
+
 		select {
 		case _, ok := <-s.closeOutputChan:
 			if !ok {
-				close(s.output)
 				break loop
 			}
-		case msg, ok := <-s.subChan:
-			if !ok {
+		case msg := <-s.control:
+			if !s.writeQueued(msg) {
 				break loop
 			}
-			err := s.writeRaw(msg)
-			if err != nil {
-				s.melody.errorHandler(s, err)
+		case msg := <-s.output:
+			if !s.writeData(msg) {
 				break loop
 			}
-
-			if msg.t == websocket.CloseMessage {
+		case msg, ok := <-s.subChan:
+			if !ok || !s.writeData(msg) {
 				break loop
 			}
+		case <-s.coalesced.notify:
+			coalesced = true
+		case <-ticker.C:
+			s.ping()
+		}
+	}
+}
 
-			if msg.t == websocket.TextMessage {
-				s.melody.messageSentHandler(s, msg.msg)
-			}
+// writeQueued 寫出佇列中的訊息，回傳writePump是否應繼續 (write a queued message, returns whether writePump should go on)
+func (s *Session) writeQueued(msg *envelope) bool {
+	if err := s.writeRaw(msg); err != nil {
+		s.melody.errorHandler(s, err)
+		return false
+	}
 
-			if msg.t == websocket.BinaryMessage {
-				s.melody.messageSentHandlerBinary(s, msg.msg)
-			}
+	if msg.t == websocket.CloseMessage {
+		return false
+	}
 
-		case msg, ok := <-s.output:
-			if !ok {
-				break loop
-			}
+	s.sent(msg)
 
-			err := s.writeRaw(msg)
+	return true
+}
 
-			if err != nil {
-				s.melody.errorHandler(s, err)
-				break loop
-			}
+// sent 觸發訊息已送出的handler (fire the sent handlers of a written message)
+func (s *Session) sent(msg *envelope) {
+	s.melody.metrics.MessageSent(msg.t, len(msg.msg))
 
-			if msg.t == websocket.CloseMessage {
-				break loop
-			}
+	err := safe(func() {
+		if msg.t == websocket.TextMessage {
+			s.melody.messageSentHandler(s, msg.msg)
+		}
 
-			if msg.t == websocket.TextMessage {
-				s.melody.messageSentHandler(s, msg.msg)
-			}
+		if msg.t == websocket.BinaryMessage {
+			s.melody.messageSentHandlerBinary(s, msg.msg)
+		}
 
-			if msg.t == websocket.BinaryMessage {
-				s.melody.messageSentHandlerBinary(s, msg.msg)
-			}
-		case <-ticker.C:
-			s.ping()
+		if msg.topic != "" {
+			s.melody.topicMessageSentHandler(s, msg.message())
 		}
-	}
+	})
 
+	if err != nil {
+		s.panicked(err)
+	}
 }
 
-func (s *Session) readPump() {
+func (s *Session) readPump() error {
 	s.conn.SetReadLimit(s.melody.Config.MaxMessageSize)
 	s.conn.SetReadDeadline(time.Now().Add(s.melody.Config.PongWait))
 
-	s.conn.SetPongHandler(func(string) error {
+	s.conn.SetPongHandler(func(appData string) error {
 		s.conn.SetReadDeadline(time.Now().Add(s.melody.Config.PongWait))
-		s.melody.pongHandler(s)
-		return nil
+		if sentAt, err := strconv.ParseInt(appData, 10, 64); err == nil {
+			s.melody.metrics.PingRTT(time.Since(time.Unix(0, sentAt)))
+		}
+		return safe(func() {
+			s.melody.pongHandler(s)
+		})
 	})
 
 	if s.melody.closeHandler != nil {
-		s.conn.SetCloseHandler(func(code int, text string) error {
-			return s.melody.closeHandler(s, code, text)
+		s.conn.SetCloseHandler(func(code int, text string) (err error) {
+			if panicErr := safe(func() {
+				err = s.melody.closeHandler(s, code, text)
+			}); panicErr != nil {
+				return panicErr
+			}
+			return err
 		})
 	}
 
@@ -200,16 +324,31 @@ func (s *Session) readPump() {
 		t, message, err := s.conn.ReadMessage()
 
 		if err != nil {
+			if _, ok := err.(*PanicError); ok {
+				s.panicked(err)
+				return err
+			}
 			s.melody.errorHandler(s, err)
-			break
+			return err
 		}
 
+		s.melody.metrics.MessageReceived(t, len(message))
+
 		if t == websocket.TextMessage {
-			s.melody.messageHandler(s, message)
+			err = safe(func() {
+				s.melody.dispatch(EventMessage, s, message, s.melody.handleMessage)
+			})
 		}
 
 		if t == websocket.BinaryMessage {
-			s.melody.messageHandlerBinary(s, message)
+			err = safe(func() {
+				s.melody.dispatch(EventMessageBinary, s, message, s.melody.handleMessageBinary)
+			})
+		}
+
+		if err != nil {
+			s.panicked(err)
+			return err
 		}
 	}
 }
@@ -242,6 +381,8 @@ func (s *Session) Close() error {
 		return errors.New("session is already closed")
 	}
 
+	s.markClosing()
+
 	s.writeMessage(&envelope{t: websocket.CloseMessage, msg: []byte{}})
 
 	return nil
@@ -254,21 +395,34 @@ func (s *Session) CloseWithMsg(msg []byte) error {
 		return errors.New("session is already closed")
 	}
 
+	s.markClosing()
+
 	s.writeMessage(&envelope{t: websocket.CloseMessage, msg: msg})
 
 	return nil
 }
 
+func (s *Session) markClosing() {
+	s.rwmutex.Lock()
+	s.closing = true
+	s.rwmutex.Unlock()
+}
+
 // Set is used to store a new key/value pair exclusivelly for this session.
-// It also lazy initializes s.Keys if it was not used previously.
+// It also lazy initializes s.Keys if it was not used previously, and updates the index of key
+// declared with Melody.IndexKey.
 func (s *Session) Set(key string, value interface{}) {
 	s.keymutex.Lock()
-	defer s.keymutex.Unlock()
 	if s.Keys == nil {
 		s.Keys = make(map[string]interface{})
 	}
 
 	s.Keys[key] = value
+	s.keymutex.Unlock()
+
+	if s.melody != nil {
+		s.melody.hub.index.update(s, key)
+	}
 }
 
 // Get returns the value for the given key, ie: (value, true).
@@ -0,0 +1,75 @@
+package melody
+
+import (
+	"net/http"
+
+	uuid "github.com/satori/go.uuid"
+)
+
+// SessionIDParam is the query parameter a client sets to choose its own session hashID, see DialClientSessionID.
+const SessionIDParam = "session_id"
+
+// DialSessionID set the func generating the hashID of new sessions, e.g. a ULID, a snowflake ID
+// encoding the node or an ID derived from a request header. An empty ID falls back to a random UUID,
+// which is also the default generator. Requests whose generated ID is already used by a session of
+// this node are answered with 400 Bad Request and ErrInvalidSessionID.
+func DialSessionID(generate func(*http.Request) string) DialOption {
+	return DialOption{func(do *dialOptions) {
+		do.sessionID = generate
+	}}
+}
+
+// DialClientSessionID let clients choose the hashID of their session with the SessionIDParam
+// query parameter. Requests whose ID is rejected by validate, or already used by a session of
+// this node, are answered with 400 Bad Request and ErrInvalidSessionID. Requests without the
+// parameter get a generated ID, see DialSessionID.
+func DialClientSessionID(validate func(r *http.Request, id string) bool) DialOption {
+	return DialOption{func(do *dialOptions) {
+		do.clientSessionID = validate
+	}}
+}
+
+// newSessionID 保留新Session的hashID，註冊時才會使用保留，失敗時須release
+// (reserve the hashID of the session requested by r on its shard, registering consumes the reservation, release it on failure)
+func (m *Melody) newSessionID(r *http.Request) (string, error) {
+	if m.clientSessionID != nil {
+		if id := r.URL.Query().Get(SessionIDParam); id != "" {
+			if !m.clientSessionID(r, id) {
+				return "", ErrInvalidSessionID
+			}
+			if !m.hub.reserve(id) {
+				return "", m.reserveError()
+			}
+
+			return id, nil
+		}
+	}
+
+	if m.sessionID != nil {
+		if id := m.sessionID(r); id != "" {
+			if !m.hub.reserve(id) {
+				return "", m.reserveError()
+			}
+
+			return id, nil
+		}
+	}
+
+	for {
+		if id := uuid.NewV4().String(); m.hub.reserve(id) {
+			return id, nil
+		}
+		if m.hub.closed() {
+			return "", ErrMelodyClosed
+		}
+	}
+}
+
+// reserveError 無法保留hashID的原因 (why a hashID could not be reserved)
+func (m *Melody) reserveError() error {
+	if m.hub.closed() {
+		return ErrMelodyClosed
+	}
+
+	return ErrInvalidSessionID
+}
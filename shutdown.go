@@ -0,0 +1,71 @@
+package melody
+
+import (
+	"context"
+	"errors"
+)
+
+// Shutdown gracefully closes the melody instance with CloseGoingAway, see ShutdownWithMsg.
+func (m *Melody) Shutdown(ctx context.Context) error {
+	return m.ShutdownWithMsg(ctx, FormatCloseMessage(CloseGoingAway, ""))
+}
+
+// ShutdownWithMsg gracefully closes the melody instance with the given close payload, e.g.
+// FormatCloseMessage(CloseServiceRestart, ""). New connections are refused right away, every
+// session is sent the close message after the messages already queued for it, and Shutdown waits
+// for the clients to answer the close handshake. Sessions still open when ctx is done are closed
+// without waiting, and ctx.Err() is returned. Connections upgraded while shutting down are sent
+// the close message and closed. Parked sessions are dropped and the pub/sub service is shut down.
+func (m *Melody) ShutdownWithMsg(ctx context.Context, msg []byte) error {
+	if m.hub.closed() {
+		return errors.New("melody instance is already closed")
+	}
+
+	sessions := m.hub.drain(msg)
+
+	m.dropParked()
+
+	for _, s := range sessions {
+		s.CloseWithMsg(msg)
+	}
+
+	var err error
+	for _, s := range sessions {
+		select {
+		case <-s.done:
+		case <-ctx.Done():
+			err = ctx.Err()
+			// 逾時強制關閉 (force close the stragglers once ctx is done)
+			s.close()
+		}
+	}
+
+	m.pubsub.Shutdown()
+
+	// 等待離開事件送出後停止presence (let the leave events of the pub/sub shutdown through, then stop presence)
+	select {
+	case <-m.pubsub.done:
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+	m.presence.stop()
+	m.slowReports.stop()
+
+	return err
+}
+
+// dropParked 結束所有等待重連的Session (finish every parked session)
+func (m *Melody) dropParked() {
+	m.parkedMutex.Lock()
+	tokens := make([]string, 0, len(m.parked))
+	for token := range m.parked {
+		tokens = append(tokens, token)
+	}
+	m.parkedMutex.Unlock()
+
+	for _, token := range tokens {
+		if s := m.unpark(token); s != nil {
+			m.finish(s)
+		}
+	}
+}
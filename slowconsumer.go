@@ -0,0 +1,294 @@
+package melody
+
+import (
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// SlowConsumerPolicy 緩衝區已滿時的處理方式 (what happens to a message when the buffer of its session is full)
+type SlowConsumerPolicy int
+
+const (
+	// DropNewest 丟棄新訊息 (drop the message which does not fit)
+	DropNewest SlowConsumerPolicy = iota
+	// DropOldest 丟棄最舊的訊息 (drop the oldest queued message to make room)
+	DropOldest
+	// Coalesce 同一個key只保留最新的訊息 (keep only the latest message per key until the session catches up)
+	Coalesce
+	// BlockWithTimeout 等待緩衝區有空間直到逾時 (wait for room until the timeout, then drop the message)
+	BlockWithTimeout
+	// Disconnect 以1008關閉過慢的Session (close the slow session with ClosePolicyViolation and report ErrSlowConsumer)
+	Disconnect
+)
+
+func (p SlowConsumerPolicy) String() string {
+	switch p {
+	case DropNewest:
+		return "drop_newest"
+	case DropOldest:
+		return "drop_oldest"
+	case Coalesce:
+		return "coalesce"
+	case BlockWithTimeout:
+		return "block_with_timeout"
+	case Disconnect:
+		return "disconnect"
+	}
+
+	return "unknown"
+}
+
+// SlowConsumer 慢速消費者設定 (how messages for a session with a full buffer are handled)
+type SlowConsumer struct {
+	Policy  SlowConsumerPolicy
+	Timeout time.Duration         // BlockWithTimeout 的等待時間 (how long BlockWithTimeout waits)
+	Key     func(*Message) string // Coalesce 的key，空字串的訊息會被丟棄 (key of Coalesce, messages with an empty key are dropped)
+}
+
+type handleSlowConsumerFunc func(*Session, string, SlowConsumerPolicy)
+
+// slowConsumerReportBuffer 等待觸發的報告上限，超過時丟棄 (reports waiting for the handler, further ones are discarded)
+const slowConsumerReportBuffer = 1024
+
+// slowConsumerReport 一次策略觸發 (a slow consumer policy which fired)
+type slowConsumerReport struct {
+	session *Session
+	topic   string
+	policy  SlowConsumerPolicy
+}
+
+// slowConsumerReports 由單一goroutine依序觸發handler的有限佇列 (bounded queue of reports fired in order by a single goroutine)
+type slowConsumerReports struct {
+	queue    chan slowConsumerReport
+	done     chan struct{} // 關機時關閉 (closed on shutdown)
+	stopOnce *sync.Once
+}
+
+func newSlowConsumerReports() *slowConsumerReports {
+	return &slowConsumerReports{
+		queue:    make(chan slowConsumerReport, slowConsumerReportBuffer),
+		done:     make(chan struct{}),
+		stopOnce: &sync.Once{},
+	}
+}
+
+// stop 結束觸發報告的goroutine (end the goroutine firing the reports)
+func (r *slowConsumerReports) stop() {
+	r.stopOnce.Do(func() {
+		close(r.done)
+	})
+}
+
+// DialSlowConsumer set how messages are handled when the buffer of a session is full, both for
+// direct writes and broadcasts (Config.MessageBufferSize) and for topic messages (the channel
+// buffer size). By default direct writes drop the newest message, synchronous publishes wait
+// for the subscriber and asynchronous publishes drop the newest message.
+func DialSlowConsumer(policy SlowConsumer) DialOption {
+	return DialOption{func(do *dialOptions) {
+		do.slowConsumer = &policy
+	}}
+}
+
+// SetTopicSlowConsumer overrides the slow consumer policy for the subscribers of topic.
+func (m *Melody) SetTopicSlowConsumer(topic string, policy SlowConsumer) {
+	m.pubsub.SetSlowConsumer(topic, policy)
+}
+
+// HandleSlowConsumer fires fn with the session, the topic ("" for direct writes and broadcasts)
+// and the policy every time a message does not fit into the buffer of a session. Reports are
+// fired in order on a single goroutine, they are discarded while too many are waiting for fn.
+func (m *Melody) HandleSlowConsumer(fn func(*Session, string, SlowConsumerPolicy)) {
+	m.slowConsumerHandler = fn
+}
+
+// reportSlowConsumer 排入報告，不會阻塞訂閱服務 (queue a report without blocking, it may be called from the pub/sub goroutine)
+func (m *Melody) reportSlowConsumer(s *Session, topic string, policy SlowConsumerPolicy) {
+	if m.slowConsumerHandler == nil {
+		return
+	}
+
+	select {
+	case m.slowReports.queue <- slowConsumerReport{session: s, topic: topic, policy: policy}:
+	default:
+	}
+}
+
+// runSlowConsumerReports 依序觸發handler直到關機 (fire the handler for every queued report until shutdown)
+func (m *Melody) runSlowConsumerReports() {
+	for {
+		select {
+		case r := <-m.slowReports.queue:
+			if handler := m.slowConsumerHandler; handler != nil {
+				if err := safe(func() {
+					handler(r.session, r.topic, r.policy)
+				}); err != nil {
+					m.errorHandler(r.session, err)
+				}
+			}
+		case <-m.slowReports.done:
+			return
+		}
+	}
+}
+
+// overflow 依策略處理放不進已滿channel的訊息，回傳訊息是否會被送出
+// (apply policy to msg which did not fit into the full ch of owner, returns whether msg will still be sent)
+func overflow(ch chan *envelope, owner *Session, msg *envelope, policy SlowConsumer) bool {
+	switch policy.Policy {
+	case DropOldest:
+		if cap(ch) == 0 {
+			// 無緩衝的channel沒有可丟棄的訊息，改為丟棄新訊息 (an unbuffered ch has nothing to evict, drop the new message instead)
+			return false
+		}
+
+		for {
+			select {
+			case ch <- msg:
+				return true
+			default:
+			}
+
+			select {
+			case old := <-ch:
+				if old.t == websocket.CloseMessage {
+					// close frame不可丟棄，Session即將關閉，改為丟棄新訊息
+					// (never evict a close frame, the session is closing anyway so drop the new message instead)
+					requeueClose(ch, old)
+					return false
+				}
+			default:
+			}
+		}
+	case Coalesce:
+		if owner == nil || policy.Key == nil {
+			return false
+		}
+
+		key := policy.Key(msg.message())
+		if key == "" {
+			return false
+		}
+
+		owner.coalesce(key, msg)
+		return true
+	case BlockWithTimeout:
+		timer := time.NewTimer(policy.Timeout)
+		defer timer.Stop()
+
+		select {
+		case ch <- msg:
+			return true
+		case <-timer.C:
+			return false
+		}
+	case Disconnect:
+		if owner != nil {
+			go owner.disconnectSlow()
+		}
+		return false
+	}
+
+	return false
+}
+
+// requeueClose 將取出的close frame放回，必要時丟棄其後的訊息，ch必須有緩衝
+// (put a close frame taken out back, evicting the messages behind it if needed; ch must be buffered, overflow checks it)
+func requeueClose(ch chan *envelope, closeMsg *envelope) {
+	for {
+		select {
+		case ch <- closeMsg:
+			return
+		default:
+		}
+
+		select {
+		case old := <-ch:
+			if old.t == websocket.CloseMessage {
+				closeMsg = old // 只需保留一個 (keeping one of them is enough)
+			}
+		default:
+		}
+	}
+}
+
+// coalescer 緩衝區已滿時以key保留最新的訊息 (latest message per key kept while the buffers are full)
+type coalescer struct {
+	mutex    *sync.Mutex
+	messages map[string]*envelope
+	notify   chan struct{}
+}
+
+func newCoalescer() *coalescer {
+	return &coalescer{
+		mutex:    &sync.Mutex{},
+		messages: make(map[string]*envelope),
+		notify:   make(chan struct{}, 1),
+	}
+}
+
+// coalesce 取代同一個key等待中的訊息 (replace the message waiting under key)
+func (s *Session) coalesce(key string, msg *envelope) {
+	c := s.coalesced
+
+	c.mutex.Lock()
+	c.messages[key] = msg
+	c.mutex.Unlock()
+
+	select {
+	case c.notify <- struct{}{}:
+	default:
+	}
+}
+
+// supersede 較新的訊息已排入緩衝區，捨棄同key等待中的訊息 (a newer message of key was queued, forget the waiting one)
+func (s *Session) supersede(policy *SlowConsumer, msg *envelope) {
+	if policy == nil || policy.Policy != Coalesce || policy.Key == nil {
+		return
+	}
+
+	c := s.coalesced
+	c.mutex.Lock()
+	if len(c.messages) > 0 {
+		delete(c.messages, policy.Key(msg.message()))
+	}
+	c.mutex.Unlock()
+}
+
+// takeCoalesced 取出所有等待中的訊息 (take every waiting message)
+func (s *Session) takeCoalesced() []*envelope {
+	c := s.coalesced
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	msgs := make([]*envelope, 0, len(c.messages))
+	for key, msg := range c.messages {
+		msgs = append(msgs, msg)
+		delete(c.messages, key)
+	}
+
+	return msgs
+}
+
+// disconnectSlow 以1008關閉Session，不經過已滿的緩衝區，並以ErrSlowConsumer通知HandleError
+// (close the session with 1008 without going through its full buffer, reporting ErrSlowConsumer to HandleError)
+func (s *Session) disconnectSlow() {
+	if s.closed() {
+		return
+	}
+
+	s.rwmutex.Lock()
+	closing := s.closing
+	s.closing = true
+	conn := s.conn
+	s.rwmutex.Unlock()
+
+	conn.WriteControl(websocket.CloseMessage, FormatCloseMessage(ClosePolicyViolation, "slow consumer"), time.Now().Add(s.melody.Config.WriteWait))
+	conn.Close()
+
+	if !closing {
+		s.melody.errorHandler(s, ErrSlowConsumer)
+	}
+}
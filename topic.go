@@ -0,0 +1,135 @@
+package melody
+
+import "strings"
+
+// Topic wildcards, topics are split into tokens by TopicSeparator.
+//
+//	"quotes.us.*" matches "quotes.us.AAPL" but not "quotes.us.AAPL.bid"
+//	"quotes.>"    matches "quotes.us" and "quotes.us.AAPL.bid" but not "quotes"
+const (
+	TopicSeparator    = "."
+	TopicWildcard     = "*" // 符合單一層 (matches exactly one token)
+	TopicFullWildcard = ">" // 符合剩下所有層，只能放最後 (matches one or more trailing tokens, must be the last token)
+)
+
+// isTopicPattern 是否包含萬用字元 (whether topic contains a valid wildcard)
+func isTopicPattern(topic string) bool {
+	tokens := strings.Split(topic, TopicSeparator)
+	for i, token := range tokens {
+		if token == TopicWildcard {
+			return true
+		}
+
+		if token == TopicFullWildcard && i == len(tokens)-1 {
+			return true
+		}
+	}
+
+	return false
+}
+
+// matchTopic 單一萬用字元訂閱是否符合主題 (whether a single pattern matches the concrete topic)
+func matchTopic(pattern, topic string) bool {
+	patternTokens := strings.Split(pattern, TopicSeparator)
+	topicTokens := strings.Split(topic, TopicSeparator)
+
+	for i, token := range patternTokens {
+		if token == TopicFullWildcard && i == len(patternTokens)-1 {
+			return len(topicTokens) > i
+		}
+
+		if i >= len(topicTokens) {
+			return false
+		}
+
+		if token != TopicWildcard && token != topicTokens[i] {
+			return false
+		}
+	}
+
+	return len(patternTokens) == len(topicTokens)
+}
+
+// topicTrie 萬用字元訂閱的前綴樹 (prefix tree of wildcard subscriptions, one level per token)
+type topicTrie struct {
+	children map[string]*topicTrie
+	pattern  string // 在此結束的訂閱 (pattern ending at this node, empty if none)
+}
+
+func newTopicTrie() *topicTrie {
+	return &topicTrie{children: make(map[string]*topicTrie)}
+}
+
+func (t *topicTrie) insert(pattern string) {
+	node := t
+	for _, token := range strings.Split(pattern, TopicSeparator) {
+		child, ok := node.children[token]
+		if !ok {
+			child = newTopicTrie()
+			node.children[token] = child
+		}
+		node = child
+	}
+	node.pattern = pattern
+}
+
+func (t *topicTrie) remove(pattern string) {
+	t.removeTokens(pattern, strings.Split(pattern, TopicSeparator))
+}
+
+// removeTokens 移除後回傳此節點是否已空 (returns whether the node became empty)
+func (t *topicTrie) removeTokens(pattern string, tokens []string) bool {
+	if len(tokens) == 0 {
+		if t.pattern == pattern {
+			t.pattern = ""
+		}
+		return t.pattern == "" && len(t.children) == 0
+	}
+
+	child, ok := t.children[tokens[0]]
+	if !ok {
+		return false
+	}
+
+	if child.removeTokens(pattern, tokens[1:]) {
+		delete(t.children, tokens[0])
+	}
+
+	return t.pattern == "" && len(t.children) == 0
+}
+
+// match 回傳所有符合topic的訂閱 (return every pattern matching the concrete topic)
+func (t *topicTrie) match(topic string) []string {
+	if len(t.children) == 0 {
+		return nil
+	}
+
+	var patterns []string
+	t.matchTokens(strings.Split(topic, TopicSeparator), &patterns)
+	return patterns
+}
+
+func (t *topicTrie) matchTokens(tokens []string, patterns *[]string) {
+	if len(tokens) == 0 {
+		if t.pattern != "" {
+			*patterns = append(*patterns, t.pattern)
+		}
+		return
+	}
+
+	if child, ok := t.children[TopicFullWildcard]; ok && child.pattern != "" {
+		*patterns = append(*patterns, child.pattern)
+	}
+
+	if child, ok := t.children[TopicWildcard]; ok {
+		child.matchTokens(tokens[1:], patterns)
+	}
+
+	if tokens[0] == TopicWildcard || tokens[0] == TopicFullWildcard {
+		return
+	}
+
+	if child, ok := t.children[tokens[0]]; ok {
+		child.matchTokens(tokens[1:], patterns)
+	}
+}